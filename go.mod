@@ -5,6 +5,22 @@ go 1.17
 require (
 	github.com/Unknwon/goconfig v1.0.0
 	github.com/cihub/seelog v0.0.0-20170130134532-f561c5e57575
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/prometheus/client_golang v1.12.2
 	github.com/rs/cors v1.8.2
+	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
+	golang.org/x/image v0.0.0-20220413100746-70e8d0d3baa9
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
@@ -9,8 +9,18 @@ import (
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/bandwidth"
 	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/routine"
+	"github.com/lyokalita/naspublic.ftserver/src/search"
 	"github.com/lyokalita/naspublic.ftserver/src/server"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+	"github.com/lyokalita/naspublic.ftserver/src/thumb"
+	"github.com/lyokalita/naspublic.ftserver/src/watch"
+	"github.com/lyokalita/naspublic.ftserver/src/webhook"
 )
 
 func main() {
@@ -20,8 +30,63 @@ func main() {
 	defer log.Flush()
 	log.Info("successfully initialized application")
 
+	// setup transfer limits
+	bandwidth.Init()
+
+	// open audit log
+	audit.Init()
+
+	// load share links
+	share.Init()
+
+	// start background job workers
+	jobs.Init()
+
+	// watch public directory for changes
+	watch.Init()
+
+	// deliver file events to webhooks
+	webhook.Init()
+
+	// load search index and rebuild it periodically, rebuild_min <= 0 disables the periodic rebuild
+	search.Init()
+	stopSearchRebuild := func() {}
+	if search.Default != nil && config.SearchRebuildMin > 0 {
+		stopSearchRebuild = routine.Every(time.Duration(config.SearchRebuildMin)*time.Minute, func() {
+			err := search.Default.Rebuild()
+			if err != nil {
+				log.Errorf("failed to rebuild search index, err: %v", err)
+			}
+			if search.Content != nil {
+				search.Content.Sync()
+			}
+		})
+	} else if search.Default != nil {
+		log.Info("periodic search index rebuild disabled")
+	}
+
+	// serve image thumbnails, unused ones are pruned daily
+	thumb.Init()
+	stopThumbPrune := func() {}
+	if thumb.Default != nil {
+		stopThumbPrune = routine.Every(24*time.Hour, func() {
+			thumb.Default.Prune(time.Duration(config.ThumbMaxAgeDays) * 24 * time.Hour)
+		})
+	}
+
+	// remove temp files of uploads interrupted by the last stop, then of uploads stalled for a day
+	go fs.PruneUploadTemp(config.PublicDirectoryRoot, time.Now())
+	stopUploadPrune := routine.Every(24*time.Hour, func() {
+		fs.PruneUploadTemp(config.PublicDirectoryRoot, time.Now().Add(-24*time.Hour))
+	})
+
 	// create http server
-	server.StartHttpServer()
+	err := server.StartHttpServer()
+	if err != nil {
+		log.Criticalf("failed to start http server, err: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
 
 	// make a new channel to notify on os interrupt of server (ctrl + C)
 	sigChan := make(chan os.Signal, 1)
@@ -29,11 +94,39 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT)
 
 	// This blocks the code until the channel receives some message
-	sig := <-sigChan
-	log.Info("received terminate, graceful shutdown", sig)
+	select {
+	case sig := <-sigChan:
+		log.Info("received terminate, graceful shutdown", sig)
+	case err := <-server.ServerErrors:
+		log.Criticalf("http server stopped unexpectedly, err: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
 	// Once message is consumed shut everything down
 	// Gracefully shuts down all client requests. Makes server more reliable
 	tc, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	server.StopHttpServer(tc)
+	jobs.Default.Stop()
+	stopSearchRebuild()
+	stopThumbPrune()
+	stopUploadPrune()
+	if thumb.Default != nil {
+		thumb.Default.Close()
+	}
+	if search.Content != nil {
+		search.Content.Close()
+	}
+	if search.Default != nil {
+		search.Default.Close()
+	}
+	if watch.Default != nil {
+		watch.Default.Stop()
+	}
+	if webhook.Default != nil {
+		webhook.Default.Stop()
+	}
+	if audit.Default != nil {
+		audit.Default.Close()
+	}
 }
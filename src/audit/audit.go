@@ -0,0 +1,361 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_FAILURE = "failure"
+	OUTCOME_DENIED  = "denied"
+)
+
+const (
+	OP_LIST          = "list"
+	OP_MKDIR         = "mkdir"
+	OP_DELETE        = "delete"
+	OP_UPLOAD        = "upload"
+	OP_DOWNLOAD_SIGN = "download.sign"
+	OP_DOWNLOAD      = "download"
+	OP_TOKEN_CREATE  = "token.create"
+	OP_SHARE_CREATE  = "share.create"
+	OP_SHARE_DELETE  = "share.delete"
+	OP_SHARE_REDEEM  = "share.redeem"
+	OP_DROPBOX       = "dropbox.upload"
+	OP_SEARCH        = "search"
+	OP_THUMB         = "thumb"
+	OP_STAT          = "stat"
+	OP_BATCH         = "batch"
+)
+
+const auditFileName = "audit.log"
+
+type Record struct {
+	Time      time.Time `json:"time"`
+	TokenId   string    `json:"tokenId,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	RequestId string    `json:"requestId,omitempty"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	// operations of a batch, Outcome is the status of the operation
+	Items []*RecordItem `json:"items,omitempty"`
+}
+
+type RecordItem struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Outcome   string `json:"outcome,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+/*
+Append-only JSON-lines audit log, the current file is rotated to audit.log.{timestamp}
+once it grows over maxSize, only the latest maxFiles rotated files are kept.
+*/
+type Logger struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+var Default *Logger
+
+func Init() {
+	l, err := NewLogger(config.AuditDirectory, config.AuditMaxSize, config.AuditMaxFiles)
+	if err != nil {
+		log.Errorf("failed to open audit log, err: %v", err)
+		return
+	}
+	Default = l
+	log.Debugf("successfully opened audit log in %s", config.AuditDirectory)
+}
+
+func NewLogger(dir string, maxSize int64, maxFiles int) (*Logger, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	l := &Logger{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write a record to the default logger, no-op if the audit log is not opened.
+func Log(rec *Record) {
+	if Default == nil {
+		return
+	}
+	err := Default.Write(rec)
+	if err != nil {
+		log.Errorf("failed to write audit record %v, err: %v", *rec, err)
+	}
+}
+
+/*
+Build a record from the outcome of an operation
+
+param:
+- err: nil for success
+*/
+func NewRecord(tokenId string, remote string, operation string, path string, bytes int64, err error) *Record {
+	rec := &Record{
+		TokenId:   tokenId,
+		Remote:    remote,
+		Operation: operation,
+		Path:      path,
+		Bytes:     bytes,
+		Outcome:   OUTCOME_SUCCESS,
+	}
+	if err != nil {
+		rec.Outcome = OUTCOME_FAILURE
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+func (l *Logger) Write(rec *Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size+int64(len(b)) > l.maxSize && l.size > 0 {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Records to query, Limit is the max number of records returned and must be positive
+type Filter struct {
+	TokenId    string
+	PathPrefix string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+var ErrInvalidLimit = fmt.Errorf("query limit must be positive")
+
+func (f *Filter) match(rec *Record) bool {
+	if f.TokenId != "" && rec.TokenId != f.TokenId {
+		return false
+	}
+	if f.PathPrefix != "" && !rec.hasPathPrefix(f.PathPrefix) {
+		return false
+	}
+	if !f.From.IsZero() && rec.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && rec.Time.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// whether the record or one of its batch operations is under prefix
+func (rec *Record) hasPathPrefix(prefix string) bool {
+	if strings.HasPrefix(rec.Path, prefix) {
+		return true
+	}
+	for _, item := range rec.Items {
+		if strings.HasPrefix(item.Path, prefix) || strings.HasPrefix(item.Target, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return records matching the filter from the oldest to the newest, the last filter.Limit records if more match.
+Only the last filter.Limit records are held while scanning. Files are opened under the lock so that a rotation cannot hide records, they are scanned without it
+so that writers are not blocked by a slow query.
+*/
+func (l *Logger) Query(filter *Filter) ([]*Record, error) {
+	if filter.Limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	opened, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+
+	last := &recordRing{size: filter.Limit}
+	for _, f := range opened {
+		err = l.scan(f, filter, last)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return last.list(), nil
+}
+
+// the last size records added
+type recordRing struct {
+	size    int
+	records []*Record
+	next    int
+}
+
+func (r *recordRing) add(rec *Record) {
+	if len(r.records) < r.size {
+		r.records = append(r.records, rec)
+		return
+	}
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % r.size
+}
+
+// records from the oldest to the newest
+func (r *recordRing) list() []*Record {
+	records := make([]*Record, 0, len(r.records))
+	records = append(records, r.records[r.next:]...)
+	return append(records, r.records[:r.next]...)
+}
+
+// open rotated and current files, writes are not buffered so every record written so far can be read
+func (l *Logger) openFiles() ([]*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	opened := make([]*os.File, 0, len(files))
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range opened {
+				f.Close()
+			}
+			return nil, err
+		}
+		opened = append(opened, f)
+	}
+	return opened, nil
+}
+
+// add records of f matching the filter, a line being written is skipped
+func (l *Logger) scan(f *os.File, filter *Filter, records *recordRing) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			continue
+		}
+		if filter.match(rec) {
+			records.add(rec)
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *Logger) currentPath() string {
+	return path.Join(l.dir, auditFileName)
+}
+
+// rotated files in chronological order followed by the current file
+func (l *Logger) files() ([]string, error) {
+	rotated, err := filepath.Glob(l.currentPath() + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	return append(rotated, l.currentPath()), nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.currentPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *Logger) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+	// nanoseconds keep rotations of the same second in order, Query relies on the name order
+	rotatedPath := fmt.Sprintf("%s.%s_%s", l.currentPath(), strings.Replace(time.Now().Format("20060102150405.000000000"), ".", "", 1), string(utils.GetRandomBytes(4)))
+	err = os.Rename(l.currentPath(), rotatedPath)
+	if err != nil {
+		return err
+	}
+	err = l.open()
+	if err != nil {
+		return err
+	}
+
+	// remove the oldest rotated files
+	files, err := l.files()
+	if err != nil {
+		return err
+	}
+	rotated := files[:len(files)-1]
+	for len(rotated) > l.maxFiles {
+		_ = os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
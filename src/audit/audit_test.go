@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQueryReturnsLastRecordsAcrossFiles(t *testing.T) {
+	// small files so that the records span several rotated files
+	l, err := NewLogger(t.TempDir(), 512, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 40; i++ {
+		if err := l.Write(NewRecord("t", "remote", OP_DELETE, fmt.Sprintf("/f%d", i), 0, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := l.files()
+	if len(files) < 3 {
+		t.Fatalf("expected rotated files, got %d", len(files))
+	}
+
+	for _, limit := range []int{1, 7, 40, 100} {
+		records, err := l.Query(&Filter{Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := limit
+		if expected > 40 {
+			expected = 40
+		}
+		if len(records) != expected {
+			t.Fatalf("limit %d: expected %d records, got %d", limit, expected, len(records))
+		}
+		for i, rec := range records {
+			if want := fmt.Sprintf("/f%d", 40-expected+i); rec.Path != want {
+				t.Fatalf("limit %d: record %d is %s, expected %s", limit, i, rec.Path, want)
+			}
+		}
+	}
+}
+
+func TestQueryRejectsNonPositiveLimit(t *testing.T) {
+	l, err := NewLogger(t.TempDir(), 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, limit := range []int{0, -1} {
+		if _, err := l.Query(&Filter{Limit: limit}); err != ErrInvalidLimit {
+			t.Fatalf("limit %d: expected ErrInvalidLimit, got %v", limit, err)
+		}
+	}
+}
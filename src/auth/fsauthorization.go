@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path"
 
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
 	"github.com/lyokalita/naspublic.ftserver/src/validate"
 )
@@ -15,6 +16,7 @@ type FsPermission struct {
 	delete    bool
 	directory string
 	expAt     int64
+	bandwidth int64
 }
 
 func (c *FsPermission) Id() string {
@@ -37,12 +39,23 @@ func (c *FsPermission) ExpAt() int64 {
 	return c.expAt
 }
 
+// Transfer limit in bytes per second granted by the token, 0 for no limit
+func (c *FsPermission) Bandwidth() int64 {
+	return c.bandwidth
+}
+
+// Full path targetPath resolves to under the token directory, without any permission check.
+func (c *FsPermission) FullPath(targetPath string) string {
+	return path.Join(c.directory, targetPath)
+}
+
+// Full path of targetPath if it can be read, files kept by the server in the public root are never accessible.
 func (c *FsPermission) CheckRead(targetPath string) (string, error) {
 	if !c.read {
 		return "", fmt.Errorf("no read permission")
 	}
 	fullTargetPath := path.Join(c.directory, targetPath)
-	if !validate.IsPathInclusive(c.directory, fullTargetPath) {
+	if !validate.IsPathInclusive(c.directory, fullTargetPath) || fs.IsUnderInternal(fullTargetPath) {
 		return "", fmt.Errorf("no read permission to %s", fullTargetPath)
 	}
 	return fullTargetPath, nil
@@ -53,7 +66,7 @@ func (c *FsPermission) CheckWrite(targetPath string) (string, error) {
 		return "", fmt.Errorf("no write permission")
 	}
 	fullTargetPath := path.Join(c.directory, targetPath)
-	if !validate.IsPathInclusive(c.directory, fullTargetPath) {
+	if !validate.IsPathInclusive(c.directory, fullTargetPath) || fs.IsUnderInternal(fullTargetPath) {
 		return "", fmt.Errorf("no write permission to %s", fullTargetPath)
 	}
 	return fullTargetPath, nil
@@ -64,7 +77,7 @@ func (c *FsPermission) CheckDelete(targetPath string) (string, error) {
 		return "", fmt.Errorf("no delete permission")
 	}
 	fullTargetPath := path.Join(c.directory, targetPath)
-	if !validate.CheckPathForDelete(c.directory, fullTargetPath) {
+	if !validate.CheckPathForDelete(c.directory, fullTargetPath) || fs.IsUnderInternal(fullTargetPath) {
 		return "", fmt.Errorf("no delete permission to %s", fullTargetPath)
 	}
 	return fullTargetPath, nil
@@ -1,7 +1,7 @@
 package auth
 
 import (
-	"fmt"
+	"errors"
 	"path"
 	"time"
 
@@ -11,10 +11,17 @@ import (
 	"github.com/lyokalita/naspublic.ftserver/src/validate"
 )
 
+var (
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidDirectory = errors.New("invalid permission directory")
+	ErrInvalidScope     = errors.New("invalid permission scope")
+)
+
 type FtAuthClaim struct {
 	*jwt.StandardClaims
-	Dir  string `json:"dir,omitempty"`
-	Mode string `json:"scope,omitempty"`
+	Dir       string `json:"dir,omitempty"`
+	Mode      string `json:"scope,omitempty"`
+	Bandwidth int64  `json:"bw,omitempty"`
 }
 
 /*
@@ -22,11 +29,12 @@ param:
 - mode: access permission, r: read/download, w: write/upload, d: delete;
 - dir: allowed directory;
 - valid: valid period in minutes, expiration date = token creation date + valid;
+- bandwidth: transfer limit in bytes per second shared by all transfers of the token, 0 for no limit;
 
 return:
 - signed token string
 */
-func GenerateJwtToken(scope string, dir string, valid int64) (string, error) {
+func GenerateJwtToken(scope string, dir string, valid int64, bandwidth int64) (string, error) {
 	expAt := time.Now().Add(time.Minute * time.Duration(valid)).Unix()
 
 	t := jwt.New(jwt.GetSigningMethod("HS256"))
@@ -39,6 +47,7 @@ func GenerateJwtToken(scope string, dir string, valid int64) (string, error) {
 		},
 		dir,
 		scope,
+		bandwidth,
 	}
 
 	return t.SignedString(config.JwtSecret)
@@ -55,12 +64,16 @@ func ValidateJwtToken(tokenString string) (*FsPermission, error) {
 	claims := token.Claims.(*FtAuthClaim)
 
 	if claims.Issuer != config.DomainName {
-		return nil, fmt.Errorf("invalid issuer")
+		return nil, ErrInvalidIssuer
+	}
+
+	if !validate.IsModeValid(claims.Mode) {
+		return nil, ErrInvalidScope
 	}
 
 	completeDir := path.Join(config.PublicDirectoryRoot, claims.Dir)
 	if !validate.IsPathInclusive(config.PublicDirectoryRoot, completeDir) {
-		return nil, fmt.Errorf("invalid permission directory")
+		return nil, ErrInvalidDirectory
 	}
 
 	return &FsPermission{
@@ -70,5 +83,31 @@ func ValidateJwtToken(tokenString string) (*FsPermission, error) {
 		delete:    claims.Mode[2] == validate.DELETE_MODE,
 		directory: completeDir,
 		expAt:     claims.ExpiresAt,
+		bandwidth: claims.Bandwidth,
 	}, nil
 }
+
+// Short reason of a ValidateJwtToken error, used as metric label.
+func ValidationFailureReason(err error) string {
+	if errors.Is(err, ErrInvalidIssuer) {
+		return "invalid_issuer"
+	}
+	if errors.Is(err, ErrInvalidDirectory) {
+		return "invalid_directory"
+	}
+	if errors.Is(err, ErrInvalidScope) {
+		return "invalid_scope"
+	}
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		switch {
+		case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+			return "expired"
+		case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			return "invalid_signature"
+		case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+			return "malformed"
+		}
+	}
+	return "invalid"
+}
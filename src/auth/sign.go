@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/lyokalita/naspublic.ftserver/src/config"
@@ -14,18 +15,32 @@ import (
 )
 
 var DLSigning *Signing = &Signing{
-	keyMap: map[string]string{},
+	keyMap: map[string]*signedKeyEntry{},
 }
 
 type Signing struct {
-	keyMap map[string]string
+	mu     sync.Mutex
+	keyMap map[string]*signedKeyEntry
 }
 
+type signedKeyEntry struct {
+	checksum string
+	expAt    int64
+}
+
+/*
+Metadata carried by a signed key.
+Keys are used once, except inline keys which stay valid until expiry since players request ranges of the file repeatedly,
+so inline keys are signed with a short expiry.
+*/
 type SignedMetadata struct {
-	TokenId  string
-	FilePath string
-	ExpAt    int64
-	Type     string
+	TokenId   string
+	FilePath  string
+	ExpAt     int64
+	Type      string
+	Bandwidth int64
+	Inline    bool
+	Slot      string // download of a share reserved for the key, see share.Store.Redeem
 }
 
 const SIGN_REGULAR = "regular"
@@ -48,7 +63,10 @@ func (m *Signing) Generate(signedMetadata *SignedMetadata) (string, string, erro
 	cipherText := aesgcm.Seal(nil, nonce, []byte(metadata), nil)
 	signedKey := hex.EncodeToString(cipherText)
 
-	m.keyMap[signedKey] = string(md5.New().Sum([]byte(metadata)))
+	m.mu.Lock()
+	m.pruneLocked()
+	m.keyMap[signedKey] = &signedKeyEntry{checksum: string(md5.New().Sum([]byte(metadata))), expAt: signedMetadata.ExpAt}
+	m.mu.Unlock()
 	return signedKey, hex.EncodeToString(nonce), nil
 }
 
@@ -80,30 +98,60 @@ func (m *Signing) Validate(signedKey string, nonce string) (*SignedMetadata, err
 		return nil, err
 	}
 
-	if chksum, ok := m.keyMap[signedKey]; ok {
-		if chksum != string(md5.New().Sum(metadataInByte)) {
-			return nil, fmt.Errorf("signing key not correct")
-		}
-	} else {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.keyMap[signedKey]
+	if !ok {
 		return nil, fmt.Errorf("signing key not found")
 	}
-	delete(m.keyMap, signedKey)
+	if entry.expAt <= time.Now().Unix() {
+		delete(m.keyMap, signedKey)
+		return nil, fmt.Errorf("signing key expired")
+	}
+	if entry.checksum != string(md5.New().Sum(metadataInByte)) {
+		return nil, fmt.Errorf("signing key not correct")
+	}
 
 	metadataInString := string(metadataInByte)
 	metadata, err := m.decodeSignedMetadata(metadataInString)
 	if err != nil {
+		delete(m.keyMap, signedKey)
 		return nil, err
 	}
+	if !metadata.Inline {
+		delete(m.keyMap, signedKey)
+	}
 	return metadata, nil
 }
 
+// drop expired keys, either never used or inline
+func (m *Signing) pruneLocked() {
+	now := time.Now().Unix()
+	for key, entry := range m.keyMap {
+		if entry.expAt <= now {
+			delete(m.keyMap, key)
+		}
+	}
+}
+
+// Number of signed keys not used yet
+func (m *Signing) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.keyMap)
+}
+
 func (m *Signing) encodeSignedMetadata(signedMetadata *SignedMetadata) string {
-	return fmt.Sprintf("%s,%s,%v,%s", signedMetadata.TokenId, signedMetadata.FilePath, signedMetadata.ExpAt, signedMetadata.Type)
+	encoded := fmt.Sprintf("%s,%s,%v,%s,%v,%v", signedMetadata.TokenId, signedMetadata.FilePath, signedMetadata.ExpAt, signedMetadata.Type, signedMetadata.Bandwidth, signedMetadata.Inline)
+	if signedMetadata.Slot != "" {
+		encoded += "," + signedMetadata.Slot
+	}
+	return encoded
 }
 
 func (m *Signing) decodeSignedMetadata(encodedString string) (*SignedMetadata, error) {
 	arr := utils.SplitRemoveEmpty(encodedString, ',')
-	if len(arr) != 4 {
+	if len(arr) != 6 && len(arr) != 7 {
 		return nil, fmt.Errorf("error metadata: %s", encodedString)
 	}
 
@@ -112,10 +160,26 @@ func (m *Signing) decodeSignedMetadata(encodedString string) (*SignedMetadata, e
 		return nil, fmt.Errorf("expired: %s", utils.ConvertUnixTimeToString(expAt))
 	}
 
-	return &SignedMetadata{
-		TokenId:  arr[0],
-		FilePath: arr[1],
-		ExpAt:    expAt,
-		Type:     arr[3],
-	}, nil
+	bandwidth, err := strconv.ParseInt(arr[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error metadata: %s", encodedString)
+	}
+
+	inline, err := strconv.ParseBool(arr[5])
+	if err != nil {
+		return nil, fmt.Errorf("error metadata: %s", encodedString)
+	}
+
+	metadata := &SignedMetadata{
+		TokenId:   arr[0],
+		FilePath:  arr[1],
+		ExpAt:     expAt,
+		Type:      arr[3],
+		Bandwidth: bandwidth,
+		Inline:    inline,
+	}
+	if len(arr) == 7 {
+		metadata.Slot = arr[6]
+	}
+	return metadata, nil
 }
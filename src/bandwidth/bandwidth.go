@@ -0,0 +1,232 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+)
+
+// largest chunk throttled at once, keeps transfers smooth at low rates
+const maxChunkSize = 32 << 10
+
+// token buckets idle for this long are dropped
+const idleBucketTimeout = 10 * time.Minute
+
+/*
+Token bucket of bytes shared by all transfers using it, rate is in bytes per second.
+A nil bucket is unlimited.
+*/
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate)
+	if burst < maxChunkSize {
+		burst = maxChunkSize
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Block until n bytes can be sent or ctx is done, n must not exceed maxChunkSize.
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+type tokenBucket struct {
+	bucket   *Bucket
+	rate     int64
+	lastUsed time.Time
+}
+
+// Global bucket and buckets per token id
+type Registry struct {
+	mu        sync.Mutex
+	global    *Bucket
+	perToken  int64
+	tokens    map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+var Default *Registry = NewRegistry(0, 0)
+
+func Init() {
+	Default = NewRegistry(config.BandwidthGlobal, config.BandwidthPerToken)
+}
+
+/*
+param:
+- global: bytes per second shared by all transfers, 0 for unlimited
+- perToken: default bytes per second shared by transfers of one token, 0 for unlimited
+*/
+func NewRegistry(global int64, perToken int64) *Registry {
+	return &Registry{
+		global:    NewBucket(global),
+		perToken:  perToken,
+		tokens:    map[string]*tokenBucket{},
+		lastPrune: time.Now(),
+	}
+}
+
+/*
+Return a limiter for a transfer of a token
+
+param:
+- scopeRate: bytes per second granted by the token claim, overrides the default per token rate if > 0
+*/
+func (reg *Registry) For(ctx context.Context, tokenId string, scopeRate int64) *Limiter {
+	rate := reg.perToken
+	if scopeRate > 0 && (rate <= 0 || scopeRate < rate) {
+		rate = scopeRate
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := time.Now()
+	reg.pruneLocked(now)
+	tb, ok := reg.tokens[tokenId]
+	if !ok || tb.rate != rate {
+		tb = &tokenBucket{bucket: NewBucket(rate), rate: rate}
+		reg.tokens[tokenId] = tb
+	}
+	tb.lastUsed = now
+	return &Limiter{
+		ctx:     ctx,
+		buckets: []*Bucket{reg.global, tb.bucket},
+	}
+}
+
+func (reg *Registry) pruneLocked(now time.Time) {
+	if now.Sub(reg.lastPrune) < idleBucketTimeout {
+		return
+	}
+	reg.lastPrune = now
+	for id, tb := range reg.tokens {
+		if now.Sub(tb.lastUsed) > idleBucketTimeout {
+			delete(reg.tokens, id)
+		}
+	}
+}
+
+// Throttle a single transfer against all buckets it belongs to
+type Limiter struct {
+	ctx     context.Context
+	buckets []*Bucket
+}
+
+func (l *Limiter) wait(n int) error {
+	for _, b := range l.buckets {
+		err := b.WaitN(l.ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Limiter) unlimited() bool {
+	for _, b := range l.buckets {
+		if b != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	if l == nil || l.unlimited() {
+		return w
+	}
+	return &writer{w: w, limiter: l}
+}
+
+// Throttle body of a response, keeps Flusher working for streamed responses.
+func (l *Limiter) ResponseWriter(rw http.ResponseWriter) http.ResponseWriter {
+	if l == nil || l.unlimited() {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: rw, w: &writer{w: rw, limiter: l}}
+}
+
+type writer struct {
+	w       io.Writer
+	limiter *Limiter
+}
+
+func (tw *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		err := tw.limiter.wait(len(chunk))
+		if err != nil {
+			return written, err
+		}
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	w *writer
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	return rw.w.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -10,22 +10,96 @@ import (
 )
 
 var (
-	ServerHost          string
-	ServerPort          int
-	ApiPath             string
-	DomainName          string
-	PublicDirectoryRoot string
-	TempDirectoryRoot   string
-	NumCore             int
-	WebfrontendOrigin   []string
-	AuthOrigin          []string
-	JwtSecret           []byte
-	SignSecret          []byte
-	AuthSecret          string
-	SSLCertPath         string
-	SSLKeyPath          string
+	ServerHost              string
+	ServerPort              int
+	ApiPath                 string
+	DomainName              string
+	PublicDirectoryRoot     string
+	TempDirectoryRoot       string
+	NumCore                 int
+	WebfrontendOrigin       []string
+	AuthOrigin              []string
+	JwtSecret               []byte
+	SignSecret              []byte
+	AuthSecret              string
+	SSLCertPath             string
+	SSLKeyPath              string
+	InlineKeyTTLSec         int
+	WatchEnabled            bool
+	WatchDebounceMs         int
+	WebhookUrls             []string
+	WebhookSecret           []byte
+	WebhookOutbox           string
+	WebhookMaxAttempts      int
+	WebhookRetrySec         int
+	AuditDirectory          string
+	AuditMaxSize            int64
+	AuditMaxFiles           int
+	AuditQueryMax           int
+	MetricsEnabled          bool
+	MetricsToken            string
+	MinFreeSpace            uint64
+	AccessLogPath           string
+	RateLimits              map[string]*RateLimit
+	LockoutMaxFailures      int
+	LockoutWindowSec        int
+	LockoutDurationSec      int
+	BandwidthGlobal         int64
+	BandwidthPerToken       int64
+	ShareStorePath          string
+	ShareBaseUrl            string
+	TreeMaxDepth            int
+	TreeMaxEntries          int
+	DirPageMax              int
+	SearchEnabled           bool
+	SearchIndexDir          string
+	SearchRebuildMin        int
+	SearchJournalMaxSize    int64
+	SearchMaxResults        int
+	SearchContentPageMax    int
+	SearchContentEnabled    bool
+	SearchContentDir        string
+	SearchContentMaxSize    int64
+	SearchContentExtensions []string
+	ThumbEnabled            bool
+	ThumbDirectory          string
+	ThumbMaxPixels          int64
+	ThumbOnUpload           bool
+	ThumbMaxAgeDays         int
+	ChecksumMaxSize         int64
+	MetadataCacheSize       int
+	BatchMaxItems           int
+	BatchStagingDir         string
+	UploadMaxFiles          int
 )
 
+// text formats extracted by the content index
+var defaultContentExtensions = []string{"txt", "md", "markdown", "rst", "csv", "tsv", "json", "yaml", "yml", "toml", "ini", "xml", "html", "css", "log", "go", "py", "js", "ts", "java", "c", "h", "cpp", "hpp", "cs", "rs", "rb", "php", "sh", "sql"}
+
+// Requests per second and burst size allowed per client ip and per token, rate 0 disables the limit
+type RateLimit struct {
+	IpRate     float64
+	IpBurst    int
+	TokenRate  float64
+	TokenBurst int
+}
+
+// default limits of routes, overridden by section [ratelimit.{route}]
+var defaultRateLimits = map[string]*RateLimit{
+	"auth":       {IpRate: 0.2, IpBurst: 5},
+	"audit":      {IpRate: 1, IpBurst: 10},
+	"download":   {IpRate: 5, IpBurst: 20, TokenRate: 5, TokenBurst: 20},
+	"upload":     {IpRate: 10, IpBurst: 50, TokenRate: 10, TokenBurst: 50},
+	"dir":        {IpRate: 20, IpBurst: 50, TokenRate: 20, TokenBurst: 50},
+	"jobs":       {IpRate: 10, IpBurst: 20},
+	"share":      {IpRate: 5, IpBurst: 20},
+	"share_link": {IpRate: 1, IpBurst: 10},
+	"search":     {IpRate: 5, IpBurst: 20, TokenRate: 5, TokenBurst: 20},
+	"thumb":      {IpRate: 50, IpBurst: 200, TokenRate: 50, TokenBurst: 200},
+	"stat":       {IpRate: 50, IpBurst: 200, TokenRate: 50, TokenBurst: 200},
+	"batch":      {IpRate: 2, IpBurst: 10, TokenRate: 2, TokenBurst: 10},
+}
+
 var (
 	configPath       string
 	seelogConfigPath string
@@ -76,6 +150,71 @@ func LoadConfig() {
 	AuthOrigin = cfg.MustValueArray("cors", "auth", ",")
 	SSLCertPath = cfg.MustValue("ssl", "cert", ".cert/localhost.cert")
 	SSLKeyPath = cfg.MustValue("ssl", "key", ".cert/localhost.key")
+	InlineKeyTTLSec = cfg.MustInt("download", "inline_ttl_sec", 300)
+	WatchEnabled = cfg.MustBool("watch", "enabled", true)
+	WatchDebounceMs = cfg.MustInt("watch", "debounce_ms", 500)
+	WebhookUrls = cfg.MustValueArray("webhook", "urls", ",")
+	WebhookOutbox = cfg.MustValue("webhook", "outbox", "./data/webhook")
+	WebhookOutbox = path.Join(WebhookOutbox)
+	WebhookMaxAttempts = cfg.MustInt("webhook", "max_attempts", 10)
+	WebhookRetrySec = cfg.MustInt("webhook", "retry_sec", 60)
+	AuditDirectory = cfg.MustValue("audit", "dir", "./audit")
+	AuditDirectory = path.Join(AuditDirectory)
+	AuditMaxSize = cfg.MustInt64("audit", "max_size", 50<<20)
+	AuditMaxFiles = cfg.MustInt("audit", "max_files", 20)
+	AuditQueryMax = cfg.MustInt("audit", "query_max", 10000)
+	MetricsEnabled = cfg.MustBool("metrics", "enabled", false)
+	MinFreeSpace = uint64(cfg.MustInt64("health", "min_free_mb", 1024)) << 20
+	AccessLogPath = cfg.MustValue("log", "access", "log/access.log")
+	RateLimits = map[string]*RateLimit{}
+	for route, def := range defaultRateLimits {
+		section := "ratelimit." + route
+		RateLimits[route] = &RateLimit{
+			IpRate:     cfg.MustFloat64(section, "ip_rate", def.IpRate),
+			IpBurst:    cfg.MustInt(section, "ip_burst", def.IpBurst),
+			TokenRate:  cfg.MustFloat64(section, "token_rate", def.TokenRate),
+			TokenBurst: cfg.MustInt(section, "token_burst", def.TokenBurst),
+		}
+	}
+	LockoutMaxFailures = cfg.MustInt("lockout", "max_failures", 5)
+	LockoutWindowSec = cfg.MustInt("lockout", "window_sec", 300)
+	LockoutDurationSec = cfg.MustInt("lockout", "duration_sec", 900)
+	BandwidthGlobal = cfg.MustInt64("bandwidth", "global", 0)
+	BandwidthPerToken = cfg.MustInt64("bandwidth", "per_token", 0)
+	ShareStorePath = cfg.MustValue("share", "store", "./data/shares.json")
+	ShareStorePath = path.Join(ShareStorePath)
+	ShareBaseUrl = cfg.MustValue("share", "base_url", "")
+	TreeMaxDepth = cfg.MustInt("dir", "tree_max_depth", 32)
+	TreeMaxEntries = cfg.MustInt("dir", "tree_max_entries", 50000)
+	DirPageMax = cfg.MustInt("dir", "page_max", 1000)
+	SearchEnabled = cfg.MustBool("search", "enabled", true)
+	SearchIndexDir = cfg.MustValue("search", "dir", "./data/search")
+	SearchIndexDir = path.Join(SearchIndexDir)
+	SearchRebuildMin = cfg.MustInt("search", "rebuild_min", 60)
+	SearchJournalMaxSize = cfg.MustInt64("search", "journal_max_size", 16<<20)
+	SearchMaxResults = cfg.MustInt("search", "max_results", 500)
+	SearchContentPageMax = cfg.MustInt("search", "content_page_max", 50)
+	SearchContentEnabled = cfg.MustBool("search", "content_enabled", false)
+	SearchContentDir = cfg.MustValue("search", "content_dir", "./data/content")
+	SearchContentDir = path.Join(SearchContentDir)
+	SearchContentMaxSize = cfg.MustInt64("search", "content_max_size", 4<<20)
+	SearchContentExtensions = cfg.MustValueArray("search", "content_extensions", ",")
+	if len(SearchContentExtensions) == 0 {
+		SearchContentExtensions = defaultContentExtensions
+	}
+	ThumbEnabled = cfg.MustBool("thumb", "enabled", true)
+	ThumbDirectory = cfg.MustValue("thumb", "dir", "./data/thumbs")
+	ThumbDirectory = path.Join(ThumbDirectory)
+	ThumbMaxPixels = cfg.MustInt64("thumb", "max_pixels", 50000000)
+	ThumbOnUpload = cfg.MustBool("thumb", "on_upload", true)
+	ThumbMaxAgeDays = cfg.MustInt("thumb", "max_age_days", 30)
+	ChecksumMaxSize = cfg.MustInt64("dir", "checksum_max_size", 1<<30)
+	MetadataCacheSize = cfg.MustInt("dir", "metadata_cache_size", 20000)
+	BatchMaxItems = cfg.MustInt("batch", "max_items", 1000)
+	UploadMaxFiles = cfg.MustInt("upload", "max_files", 1000)
+	// deleted targets wait here until an atomic batch completes, keep it on the filesystem of the public root so staging is a rename
+	BatchStagingDir = cfg.MustValue("batch", "staging_dir", path.Join(PublicDirectoryRoot, ".batch-staging"))
+	BatchStagingDir = path.Join(BatchStagingDir)
 
 	err = CreateDirectories()
 	if err != nil {
@@ -88,6 +227,14 @@ func LoadConfig() {
 	if len(JwtSecret) == 0 || len(SignSecret) == 0 || AuthSecret == "" {
 		panic("failed to load secrets")
 	}
+	MetricsToken = os.Getenv("NASPUBLIC_METRICS_TOKEN")
+	if MetricsEnabled && MetricsToken == "" {
+		panic("failed to load metrics token")
+	}
+	WebhookSecret = []byte(os.Getenv("NASPUBLIC_WEBHOOK_SECRET"))
+	if len(WebhookUrls) > 0 && len(WebhookSecret) == 0 {
+		panic("failed to load webhook secret")
+	}
 	log.Debugf("successfully loaded config, public root: %s, NumCore: %d, Cors: frontend: %v, auth: %v, ssl cert path: %s, ssl key path: %s", PublicDirectoryRoot, NumCore, WebfrontendOrigin, AuthOrigin, SSLCertPath, SSLKeyPath)
 }
 
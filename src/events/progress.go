@@ -0,0 +1,141 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	PROGRESS_RUNNING = "running"
+	PROGRESS_DONE    = "done"
+	PROGRESS_FAILED  = "failed"
+)
+
+// minimum interval between two running events of the same operation
+const reportInterval = 200 * time.Millisecond
+
+// buffered events per subscriber, events are dropped for slow subscribers
+const subscriberBuffer = 64
+
+type ProgressEvent struct {
+	Operation  string `json:"operation"`
+	Id         string `json:"id"`
+	State      string `json:"state"`
+	Bytes      int64  `json:"bytes"`
+	Total      int64  `json:"total"`
+	PartsDone  int    `json:"partsDone,omitempty"`
+	PartsTotal int    `json:"partsTotal,omitempty"`
+	Current    string `json:"current,omitempty"`
+}
+
+// Fan out events to subscribers of the same owner (token id)
+type Broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *ProgressEvent]struct{}
+}
+
+var Progress *Broker = NewBroker()
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs: map[string]map[chan *ProgressEvent]struct{}{},
+	}
+}
+
+/*
+Subscribe events of an owner
+
+return:
+- channel of events
+- function to unsubscribe, the channel is closed after it is called
+*/
+func (b *Broker) Subscribe(owner string) (<-chan *ProgressEvent, func()) {
+	ch := make(chan *ProgressEvent, subscriberBuffer)
+	b.mu.Lock()
+	if b.subs[owner] == nil {
+		b.subs[owner] = map[chan *ProgressEvent]struct{}{}
+	}
+	b.subs[owner][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[owner], ch)
+			if len(b.subs[owner]) == 0 {
+				delete(b.subs, owner)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Send event to all subscribers of owner without blocking.
+func (b *Broker) Publish(owner string, e *ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[owner] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (b *Broker) HasSubscribers(owner string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs[owner]) > 0
+}
+
+// Publish progress of one operation, running events are throttled.
+type Reporter struct {
+	broker    *Broker
+	owner     string
+	operation string
+	id        string
+	mu        sync.Mutex
+	last      time.Time
+}
+
+func (b *Broker) NewReporter(owner string, operation string, id string) *Reporter {
+	return &Reporter{
+		broker:    b,
+		owner:     owner,
+		operation: operation,
+		id:        id,
+	}
+}
+
+func (r *Reporter) Id() string {
+	return r.id
+}
+
+func (r *Reporter) Running(e *ProgressEvent) {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.last) < reportInterval && e.Bytes < e.Total {
+		r.mu.Unlock()
+		return
+	}
+	r.last = now
+	r.mu.Unlock()
+	r.publish(PROGRESS_RUNNING, e)
+}
+
+func (r *Reporter) Done(e *ProgressEvent) {
+	r.publish(PROGRESS_DONE, e)
+}
+
+func (r *Reporter) Failed(e *ProgressEvent) {
+	r.publish(PROGRESS_FAILED, e)
+}
+
+func (r *Reporter) publish(state string, e *ProgressEvent) {
+	e.Operation = r.operation
+	e.Id = r.id
+	e.State = state
+	r.broker.Publish(r.owner, e)
+}
@@ -0,0 +1,317 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	BATCH_DELETE = "delete"
+	BATCH_MOVE   = "move"
+	BATCH_COPY   = "copy"
+	BATCH_MKDIR  = "mkdir"
+)
+
+const (
+	BATCH_OK          = "ok"
+	BATCH_FAILED      = "failed"
+	BATCH_ROLLED_BACK = "rolled_back"
+	BATCH_SKIPPED     = "skipped"
+)
+
+var (
+	ErrTargetExists = fmt.Errorf("target already exists")
+	ErrIntoItself   = fmt.Errorf("cannot move or copy a folder into itself")
+)
+
+// One operation of a batch on full paths, Source is empty for mkdir and Target is empty for delete
+type BatchOperation struct {
+	Op     string
+	Source string
+	Target string
+}
+
+type BatchResult struct {
+	Status string
+	Err    error
+}
+
+/*
+Run operations in order, a failed operation does not stop the following ones.
+In atomic mode the batch stops at the first failure and the operations done so far are undone:
+deleted targets are moved to stagingDir until the batch completes so they can be restored,
+it is kept if an undo fails so that nothing is lost.
+Once ctx is done the remaining operations are skipped, an atomic batch is rolled back.
+
+param:
+- onProgress: optional, called with the number of operations run so far
+
+return:
+- result of each operation, in the same order
+*/
+func RunBatch(ctx context.Context, ops []*BatchOperation, atomic bool, stagingDir string, onProgress func(done int)) []*BatchResult {
+	results := make([]*BatchResult, len(ops))
+	if onProgress == nil {
+		onProgress = func(int) {}
+	}
+	if !atomic {
+		for i, op := range ops {
+			if ctx.Err() != nil {
+				results[i] = &BatchResult{Status: BATCH_SKIPPED, Err: ctx.Err()}
+				continue
+			}
+			_, err := runStaged(op, "")
+			results[i] = newBatchResult(err)
+			onProgress(i + 1)
+		}
+		return results
+	}
+
+	err := os.MkdirAll(stagingDir, os.ModePerm)
+	if err != nil {
+		for i := range ops {
+			results[i] = &BatchResult{Status: BATCH_SKIPPED, Err: err}
+		}
+		return results
+	}
+	// staged deletes are the only copy left when an undo fails
+	keepStaging := false
+	defer func() {
+		if keepStaging {
+			log.Errorf("rollback incomplete, staged files are kept in %s", stagingDir)
+			return
+		}
+		os.RemoveAll(stagingDir)
+	}()
+
+	undo := make([]func() error, 0, len(ops))
+	for i, op := range ops {
+		if ctx.Err() != nil {
+			results[i] = &BatchResult{Status: BATCH_SKIPPED, Err: ctx.Err()}
+		} else {
+			undoOp, err := runStaged(op, stagingDir)
+			if err == nil {
+				results[i] = &BatchResult{Status: BATCH_OK}
+				undo = append(undo, undoOp)
+				onProgress(i + 1)
+				continue
+			}
+			results[i] = &BatchResult{Status: BATCH_FAILED, Err: err}
+		}
+
+		// undo in reverse order, then report what was not run
+		for j := len(undo) - 1; j >= 0; j-- {
+			results[j].Status = BATCH_ROLLED_BACK
+			uerr := undo[j]()
+			if uerr != nil {
+				log.Errorf("failed to roll back %s %s, err: %v", ops[j].Op, ops[j].Target, uerr)
+				keepStaging = true
+				results[j].Status = BATCH_FAILED
+				results[j].Err = fmt.Errorf("rollback failed: %v", uerr)
+			}
+		}
+		for j := i + 1; j < len(ops); j++ {
+			results[j] = &BatchResult{Status: BATCH_SKIPPED}
+		}
+		return results
+	}
+	return results
+}
+
+func newBatchResult(err error) *BatchResult {
+	if err != nil {
+		return &BatchResult{Status: BATCH_FAILED, Err: err}
+	}
+	return &BatchResult{Status: BATCH_OK}
+}
+
+/*
+Run one operation, a delete is staged instead of removed when stagingDir is given.
+
+return:
+- function reverting the operation
+*/
+func runStaged(op *BatchOperation, stagingDir string) (func() error, error) {
+	switch op.Op {
+	case BATCH_DELETE:
+		_, err := os.Lstat(op.Source)
+		if err != nil {
+			return nil, err
+		}
+		if stagingDir == "" {
+			return nil, os.RemoveAll(op.Source)
+		}
+		staged := path.Join(stagingDir, string(utils.GetRandomBytes(8)))
+		err = Move(op.Source, staged)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return Move(staged, op.Source) }, nil
+
+	case BATCH_MOVE:
+		err := checkTransfer(op.Source, op.Target)
+		if err != nil {
+			return nil, err
+		}
+		err = Move(op.Source, op.Target)
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return Move(op.Target, op.Source) }, nil
+
+	case BATCH_COPY:
+		err := checkTransfer(op.Source, op.Target)
+		if err != nil {
+			return nil, err
+		}
+		err = Copy(op.Source, op.Target)
+		if err != nil {
+			os.RemoveAll(op.Target)
+			return nil, err
+		}
+		return func() error { return os.RemoveAll(op.Target) }, nil
+
+	case BATCH_MKDIR:
+		err := os.Mkdir(op.Target, os.ModePerm)
+		if os.IsExist(err) {
+			return nil, ErrTargetExists
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() error { return os.Remove(op.Target) }, nil
+	}
+	return nil, fmt.Errorf("unknown operation %s", op.Op)
+}
+
+// source must exist, target must not, and a folder cannot go under itself
+func checkTransfer(source string, target string) error {
+	_, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	_, err = os.Lstat(target)
+	if err == nil {
+		return ErrTargetExists
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if target == source || isUnder(source, target) {
+		return ErrIntoItself
+	}
+	return nil
+}
+
+// whether p is a path strictly under dir
+func isUnder(dir string, p string) bool {
+	return len(p) > len(dir) && p[:len(dir)] == dir && p[len(dir)] == '/'
+}
+
+// Rename source to target, copied then removed when they are on different filesystems.
+func Move(source string, target string) error {
+	err := os.Rename(source, target)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	err = Copy(source, target)
+	if err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+	return os.RemoveAll(source)
+}
+
+/*
+Remove a file or a folder with everything under it, like os.RemoveAll, checking ctx before each entry.
+Once ctx is done the removal stops and ctx.Err() is returned, what was removed so far stays removed.
+*/
+func RemoveAll(ctx context.Context, target string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			err = RemoveAll(ctx, path.Join(target, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = os.Remove(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Copy a file or a folder recursively, modes are kept and symbolic links are copied as links.
+func Copy(source string, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+
+	case info.IsDir():
+		err = os.Mkdir(target, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = Copy(path.Join(source, entry.Name()), path.Join(target, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return copyFile(source, target, info.Mode().Perm())
+}
+
+func copyFile(source string, target string, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
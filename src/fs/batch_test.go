@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// dir/a.txt, dir/b.txt and dir/sub/c.txt
+func newBatchDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(path.Join(dir, "sub"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt"} {
+		if err := os.WriteFile(path.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func batchStatuses(results []*BatchResult) []string {
+	statuses := make([]string, len(results))
+	for i, res := range results {
+		statuses[i] = res.Status
+	}
+	return statuses
+}
+
+func assertExists(t *testing.T, dir string, names []string, exists bool) {
+	t.Helper()
+	for _, name := range names {
+		_, err := os.Lstat(path.Join(dir, name))
+		if exists && err != nil {
+			t.Fatalf("%s missing, err: %v", name, err)
+		}
+		if !exists && !os.IsNotExist(err) {
+			t.Fatalf("%s left behind, err: %v", name, err)
+		}
+	}
+}
+
+func TestRunBatchAtomic(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(dir string) []*BatchOperation
+		// called after each operation that succeeded
+		onProgress func(t *testing.T, dir string, cancel context.CancelFunc)
+		statuses   []string
+		exists     []string
+		missing    []string
+		staged     int // entries left in the staging folder, -1 if it is removed
+	}{
+		{
+			name: "rollback",
+			ops: func(dir string) []*BatchOperation {
+				return []*BatchOperation{
+					{Op: BATCH_MKDIR, Target: path.Join(dir, "new")},
+					{Op: BATCH_DELETE, Source: path.Join(dir, "a.txt")},
+					{Op: BATCH_MOVE, Source: path.Join(dir, "b.txt"), Target: path.Join(dir, "moved.txt")},
+					{Op: BATCH_COPY, Source: path.Join(dir, "sub"), Target: path.Join(dir, "copied")},
+					{Op: BATCH_MKDIR, Target: path.Join(dir, "sub")},
+					{Op: BATCH_DELETE, Source: path.Join(dir, "sub")},
+				}
+			},
+			statuses: []string{BATCH_ROLLED_BACK, BATCH_ROLLED_BACK, BATCH_ROLLED_BACK, BATCH_ROLLED_BACK, BATCH_FAILED, BATCH_SKIPPED},
+			exists:   []string{"a.txt", "b.txt", "sub/c.txt"},
+			missing:  []string{"new", "moved.txt", "copied"},
+			staged:   -1,
+		},
+		{
+			name: "undo failure keeps staging",
+			ops: func(dir string) []*BatchOperation {
+				return []*BatchOperation{
+					{Op: BATCH_DELETE, Source: path.Join(dir, "sub")},
+					{Op: BATCH_MKDIR, Target: path.Join(dir, "a.txt")},
+				}
+			},
+			// a new folder in place of the deleted one, the staged folder cannot be moved back
+			onProgress: func(t *testing.T, dir string, cancel context.CancelFunc) {
+				if err := os.MkdirAll(path.Join(dir, "sub", "other"), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+			statuses: []string{BATCH_FAILED, BATCH_FAILED},
+			exists:   []string{"sub/other"},
+			missing:  []string{"sub/c.txt"},
+			staged:   1,
+		},
+		{
+			name: "cancelled",
+			ops: func(dir string) []*BatchOperation {
+				return []*BatchOperation{
+					{Op: BATCH_MKDIR, Target: path.Join(dir, "new")},
+					{Op: BATCH_DELETE, Source: path.Join(dir, "a.txt")},
+					{Op: BATCH_MKDIR, Target: path.Join(dir, "other")},
+				}
+			},
+			onProgress: func(t *testing.T, dir string, cancel context.CancelFunc) {
+				cancel()
+			},
+			statuses: []string{BATCH_ROLLED_BACK, BATCH_SKIPPED, BATCH_SKIPPED},
+			exists:   []string{"a.txt"},
+			missing:  []string{"new", "other"},
+			staged:   -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := newBatchDir(t)
+			stagingDir := path.Join(t.TempDir(), "staging")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var onProgress func(int)
+			if test.onProgress != nil {
+				onProgress = func(int) { test.onProgress(t, dir, cancel) }
+			}
+
+			results := RunBatch(ctx, test.ops(dir), true, stagingDir, onProgress)
+
+			if statuses := batchStatuses(results); !reflect.DeepEqual(statuses, test.statuses) {
+				t.Fatalf("expected %v, got %v", test.statuses, statuses)
+			}
+			assertExists(t, dir, test.exists, true)
+			assertExists(t, dir, test.missing, false)
+			entries, err := os.ReadDir(stagingDir)
+			switch {
+			case test.staged < 0 && !os.IsNotExist(err):
+				t.Fatalf("staging folder not removed, err: %v", err)
+			case test.staged >= 0 && len(entries) != test.staged:
+				t.Fatalf("expected %d staged entries, got %d, err: %v", test.staged, len(entries), err)
+			}
+		})
+	}
+}
+
+func TestRunBatchIntoItself(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		source string
+		target string
+		err    error
+	}{
+		{"move into itself", BATCH_MOVE, "sub", "sub/inner", ErrIntoItself},
+		{"copy into itself", BATCH_COPY, "sub", "sub/inner/deeper", ErrIntoItself},
+		{"copy onto itself", BATCH_COPY, "sub", "sub", ErrTargetExists},
+		{"copy next to itself", BATCH_COPY, "sub", "sub-copy", nil},
+		{"move next to itself", BATCH_MOVE, "a.txt", "a.txt.old", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := newBatchDir(t)
+			op := &BatchOperation{Op: test.op, Source: path.Join(dir, test.source), Target: path.Join(dir, test.target)}
+
+			results := RunBatch(context.Background(), []*BatchOperation{op}, false, "", nil)
+
+			if !errors.Is(results[0].Err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, results[0].Err)
+			}
+			if test.err != nil {
+				assertExists(t, dir, []string{test.source}, true)
+				assertExists(t, dir, []string{"sub/inner"}, false)
+			}
+		})
+	}
+}
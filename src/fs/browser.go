@@ -1,37 +1,113 @@
 package fs
 
 import (
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
 
+	"github.com/lyokalita/naspublic.ftserver/src/config"
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
 )
 
+// Entry of a listing, fields after LastModified are only filled in when selected, see Enrich
 type FileMetadata struct {
 	Name         string `json:"name"`
 	Type         string `json:"type"`
 	Size         int64  `json:"size"`
 	LastModified string `json:"date"`
+	Mime         string `json:"mime,omitempty"`
+	Modified     string `json:"modified,omitempty"`
+	Created      string `json:"created,omitempty"`
+	Accessed     string `json:"accessed,omitempty"`
+	Mode         string `json:"mode,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	Taken        string `json:"taken,omitempty"`
 }
 
-func GetFileMetadataList(dirPath string) ([]*FileMetadata, error) {
-	files, err := ioutil.ReadDir(dirPath)
+func NewFileMetadata(info os.FileInfo) *FileMetadata {
+	fileType := TYPE_FOLDER
+	if !info.IsDir() {
+		fileType = utils.GetFileExtension(info.Name())
+	}
+	return &FileMetadata{
+		Name:         info.Name(),
+		Size:         info.Size(),
+		Type:         fileType,
+		LastModified: info.ModTime().Format(utils.GetDateFormatString()),
+	}
+}
+
+// Metadata of a single file or folder with the selected optional fields.
+func StatFileMetadata(fullPath string, fields Fields) (*FileMetadata, os.FileInfo, error) {
+	info, err := os.Stat(fullPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	metadataList := []*FileMetadata{}
-	for _, file := range files {
-		fileType := ""
-		if file.IsDir() {
-			fileType = "Folder"
-		} else {
-			fileType = utils.GetFileExtension(file.Name())
+	metadata := NewFileMetadata(info)
+	metadata.Enrich(fullPath, info, fields)
+	return metadata, info, nil
+}
+
+// Check whether fullPath is kept by the server itself in the public root, such paths are left out of listings and search.
+func IsInternal(fullPath string) bool {
+	return strings.HasPrefix(path.Base(fullPath), UPLOAD_TEMP_PREFIX) || path.Clean(fullPath) == config.BatchStagingDir
+}
+
+// Check whether fullPath is internal or inside an internal folder, clients are refused access to such paths.
+func IsUnderInternal(fullPath string) bool {
+	for p := path.Clean(fullPath); ; p = path.Dir(p) {
+		if IsInternal(p) {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
 		}
-		metadataList = append(metadataList, &FileMetadata{
-			Name:         file.Name(),
-			Size:         file.Size(),
-			Type:         fileType,
-			LastModified: file.ModTime().Format(utils.GetDateFormatString()),
-		})
 	}
+}
+
+// Count direct children of a folder without reading their metadata.
+func CountChildren(dirPath string) (files int, folders int, err error) {
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	for {
+		entries, err := f.ReadDir(readDirBatch)
+		for _, entry := range entries {
+			if IsInternal(path.Join(dirPath, entry.Name())) {
+				continue
+			}
+			if entry.IsDir() {
+				folders++
+			} else {
+				files++
+			}
+		}
+		if err == io.EOF {
+			return files, folders, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// Version of a file for ETag headers, changes with its size or modification time.
+func ETag(info os.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", info.Name(), info.Size(), info.ModTime().UnixNano())))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// List all entries of a directory sorted by name.
+func GetFileMetadataList(dirPath string) ([]*FileMetadata, error) {
+	metadataList, _, err := ListFileMetadata(dirPath, &ListOptions{})
 	return metadataList, err
 }
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,7 +13,28 @@ import (
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
 )
 
+/*
+Called while zipping files.
+
+param:
+- written: bytes of source files zipped so far
+- total: total bytes of source files
+- current: source file being zipped
+*/
+type ProgressFunc func(written int64, total int64, current string)
+
 func ServeMultipleFilesWithCompression(fileList []string) (string, error) {
+	return CompressFiles(context.Background(), fileList, nil)
+}
+
+/*
+Zip files and folders into a new file under the temp directory, stops when ctx is done.
+onProgress is optional.
+
+return:
+- path of the zip file, it is returned even on error so that the caller can clean it
+*/
+func CompressFiles(ctx context.Context, fileList []string, onProgress ProgressFunc) (string, error) {
 	// 1. Create a ZIP file and zip.Writer
 	zipName := fmt.Sprintf("%s_%s.zip", utils.GetCurrentTimeCompact(), string(utils.GetRandomBytes(8)))
 	zipTarget := path.Join(config.TempDirectoryRoot, zipName)
@@ -25,21 +47,70 @@ func ServeMultipleFilesWithCompression(fileList []string) (string, error) {
 	writer := zip.NewWriter(f)
 	defer writer.Close()
 
+	progress := &zipProgress{ctx: ctx, onProgress: onProgress}
+	if onProgress != nil {
+		progress.total, err = totalSize(fileList)
+		if err != nil {
+			return zipTarget, err
+		}
+	}
+
 	// 2. Go through all the files of the source
 	for _, file := range fileList {
-		err := zipFile(file, writer)
+		err := zipFile(file, writer, progress)
 		if err != nil {
-			return "", err
+			return zipTarget, err
 		}
 	}
 	return zipTarget, nil
 }
 
-func zipFile(source string, writer *zip.Writer) error {
+type zipProgress struct {
+	ctx        context.Context
+	onProgress ProgressFunc
+	written    int64
+	total      int64
+	current    string
+}
+
+func (p *zipProgress) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	p.written += int64(len(b))
+	if p.onProgress != nil {
+		p.onProgress(p.written, p.total, p.current)
+	}
+	return len(b), nil
+}
+
+func totalSize(fileList []string) (int64, error) {
+	var total int64 = 0
+	for _, file := range fileList {
+		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+func zipFile(source string, writer *zip.Writer, progress *zipProgress) error {
 	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := progress.ctx.Err(); err != nil {
+			return err
+		}
 
 		// 3. Create a local file header
 		header, err := zip.FileInfoHeader(info)
@@ -75,7 +146,8 @@ func zipFile(source string, writer *zip.Writer) error {
 		}
 		defer f.Close()
 
-		_, err = io.Copy(headerWriter, f)
+		progress.current = header.Name
+		_, err = io.Copy(io.MultiWriter(headerWriter, progress), f)
 		return err
 	})
 }
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	exifTagDateTime           = 0x0132
+	exifTagExifIfd            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTypeAscii             = 2
+	exifTypeLong              = 4
+	exifMaxSegment            = 64 << 10
+)
+
+/*
+Read the capture date of a JPEG from its EXIF data, DateTimeOriginal or else DateTime.
+EXIF dates have no zone unless OffsetTimeOriginal is present, in that case the date is returned
+with the offset, otherwise it is returned as the wall clock time of the camera.
+
+return:
+- date in RFC3339, or "2006-01-02T15:04:05" without zone
+*/
+func ReadExifDate(r io.Reader) (string, error) {
+	tiff, err := readExifSegment(bufio.NewReader(r))
+	if err != nil {
+		return "", err
+	}
+	if len(tiff) < 8 {
+		return "", fmt.Errorf("short exif data")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return "", fmt.Errorf("invalid exif byte order")
+	}
+
+	ifd0 := readIfd(tiff, order, order.Uint32(tiff[4:8]))
+	date := ifd0[exifTagDateTime]
+	offset := ""
+	if exifIfd, ok := ifd0[exifTagExifIfd]; ok && len(exifIfd) == 4 {
+		sub := readIfd(tiff, order, order.Uint32([]byte(exifIfd)))
+		if original, ok := sub[exifTagDateTimeOriginal]; ok {
+			date = original
+		}
+		offset = sub[exifTagOffsetTimeOriginal]
+	}
+	date = strings.TrimRight(date, "\x00 ")
+	if date == "" {
+		return "", fmt.Errorf("no exif date")
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", date)
+	if err != nil {
+		return "", err
+	}
+	offset = strings.TrimRight(offset, "\x00 ")
+	if offset != "" {
+		zoned, err := time.Parse("2006-01-02T15:04:05-07:00", t.Format("2006-01-02T15:04:05")+offset)
+		if err == nil {
+			return zoned.Format(time.RFC3339), nil
+		}
+	}
+	return t.Format("2006-01-02T15:04:05"), nil
+}
+
+// find the APP1 Exif segment of a JPEG and return its TIFF data
+func readExifSegment(r *bufio.Reader) ([]byte, error) {
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(r, soi)
+	if err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	for {
+		marker := make([]byte, 4)
+		_, err = io.ReadFull(r, marker)
+		if err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xFF || marker[1] == 0xDA {
+			// image data starts, no exif before it
+			return nil, fmt.Errorf("no exif data")
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid jpeg segment")
+		}
+		if marker[1] != 0xE1 || length > exifMaxSegment {
+			_, err = r.Discard(length)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(string(segment), "Exif\x00\x00") {
+			return segment[6:], nil
+		}
+	}
+}
+
+// read ascii and long entries of an IFD, long values are kept as their 4 raw bytes
+func readIfd(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]string {
+	entries := map[uint16]string{}
+	if int(offset)+2 > len(tiff) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		tag := order.Uint16(entry[0:])
+		typ := order.Uint16(entry[2:])
+		n := order.Uint32(entry[4:])
+		switch typ {
+		case exifTypeLong:
+			entries[tag] = string(entry[8:12])
+		case exifTypeAscii:
+			if n <= 4 {
+				entries[tag] = string(entry[8 : 8+n])
+				continue
+			}
+			valueOffset := order.Uint32(entry[8:])
+			if uint64(valueOffset)+uint64(n) <= uint64(len(tiff)) {
+				entries[tag] = string(tiff[valueOffset : valueOffset+n])
+			}
+		}
+	}
+	return entries
+}
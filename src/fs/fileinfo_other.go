@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"os"
+	"time"
+)
+
+// Creation time is not read on this platform.
+func createdTime(fullPath string, info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// Access time is not read on this platform.
+func accessedTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// Owner is not read on this platform.
+func ownerId(info os.FileInfo) (uint32, bool) {
+	return 0, false
+}
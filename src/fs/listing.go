@@ -0,0 +1,294 @@
+package fs
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	SORT_NAME = "name"
+	SORT_SIZE = "size"
+	SORT_DATE = "date"
+	SORT_TYPE = "type"
+)
+
+const TYPE_FOLDER = "Folder"
+
+// entries read from the directory at a time
+const readDirBatch = 1024
+
+/*
+Options of listing a directory, zero values list everything sorted by name
+
+- Pattern: glob matched against names, case insensitive
+- Extensions: keep files with one of the extensions, folders are always kept
+- Limit: max entries returned, 0 for no limit
+- Cursor: returned by the previous page, the listing continues after it
+- Fields: optional metadata to fill in
+*/
+type ListOptions struct {
+	Sort         string
+	Desc         bool
+	FoldersFirst bool
+	Pattern      string
+	Extensions   []string
+	HideHidden   bool
+	Limit        int
+	Cursor       string
+	Fields       Fields
+}
+
+// Check sort, pattern and cursor are well formed.
+func (opts *ListOptions) Validate() error {
+	switch opts.Sort {
+	case "", SORT_NAME, SORT_SIZE, SORT_DATE, SORT_TYPE:
+	default:
+		return fmt.Errorf("invalid sort %s", opts.Sort)
+	}
+	if opts.Pattern != "" {
+		_, err := path.Match(strings.ToLower(opts.Pattern), "")
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Cursor != "" {
+		_, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+List a directory page by page. The directory is read in batches and only the entries of the
+requested page are kept, so memory depends on the page size rather than the directory size.
+
+return:
+- entries of the page
+- cursor of the next page, empty if this is the last page
+*/
+func ListFileMetadata(dirPath string, opts *ListOptions) ([]*FileMetadata, string, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+	var after *listItem
+	if opts.Cursor != "" {
+		after, err = decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	// max heap on the listing order, holds the first Limit entries seen so far
+	page := &listHeap{opts: opts}
+	more := false
+	for {
+		entries, err := f.ReadDir(readDirBatch)
+		for _, entry := range entries {
+			item := &listItem{entry: entry, Name: entry.Name(), IsDir: entry.IsDir()}
+			if IsInternal(path.Join(dirPath, item.Name)) || !opts.keep(item) {
+				continue
+			}
+			if item.load(opts) != nil {
+				// removed while listing
+				continue
+			}
+			if after != nil && !opts.less(after, item) {
+				continue
+			}
+			if opts.Limit <= 0 || page.Len() < opts.Limit {
+				heap.Push(page, item)
+				continue
+			}
+			more = true
+			if opts.less(item, page.items[0]) {
+				page.items[0] = item
+				heap.Fix(page, 0)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	sort.Slice(page.items, func(i, j int) bool {
+		return opts.less(page.items[i], page.items[j])
+	})
+	metadataList := []*FileMetadata{}
+	for _, item := range page.items {
+		metadata, err := item.metadata()
+		if err != nil {
+			continue
+		}
+		metadata.Enrich(path.Join(dirPath, item.Name), item.info, opts.Fields)
+		metadataList = append(metadataList, metadata)
+	}
+
+	next := ""
+	if more && len(page.items) > 0 {
+		next = encodeCursor(page.items[len(page.items)-1])
+	}
+	return metadataList, next, nil
+}
+
+// entry of a listing, exported fields are kept in the cursor
+type listItem struct {
+	Name    string `json:"n"`
+	IsDir   bool   `json:"d,omitempty"`
+	Size    int64  `json:"s,omitempty"`
+	ModTime int64  `json:"t,omitempty"`
+	entry   os.DirEntry
+	info    os.FileInfo
+}
+
+// stat the entry if the sort order needs it
+func (it *listItem) load(opts *ListOptions) error {
+	if opts.Sort != SORT_SIZE && opts.Sort != SORT_DATE {
+		return nil
+	}
+	_, err := it.getInfo()
+	return err
+}
+
+func (it *listItem) getInfo() (os.FileInfo, error) {
+	if it.info != nil {
+		return it.info, nil
+	}
+	info, err := it.entry.Info()
+	if err != nil {
+		return nil, err
+	}
+	it.info = info
+	it.Size = info.Size()
+	it.ModTime = info.ModTime().UnixNano()
+	return info, nil
+}
+
+func (it *listItem) fileType() string {
+	if it.IsDir {
+		return TYPE_FOLDER
+	}
+	return utils.GetFileExtension(it.Name)
+}
+
+func (it *listItem) metadata() (*FileMetadata, error) {
+	info, err := it.getInfo()
+	if err != nil {
+		return nil, err
+	}
+	return NewFileMetadata(info), nil
+}
+
+// check filters of the options
+func (opts *ListOptions) keep(it *listItem) bool {
+	if opts.HideHidden && strings.HasPrefix(it.Name, ".") {
+		return false
+	}
+	if opts.Pattern != "" {
+		matched, _ := path.Match(strings.ToLower(opts.Pattern), strings.ToLower(it.Name))
+		if !matched {
+			return false
+		}
+	}
+	if len(opts.Extensions) > 0 && !it.IsDir {
+		ext := strings.ToLower(utils.GetFileExtension(it.Name))
+		for _, e := range opts.Extensions {
+			if strings.ToLower(strings.TrimPrefix(e, ".")) == ext {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// listing order, names break ties so that cursors are exact
+func (opts *ListOptions) less(a *listItem, b *listItem) bool {
+	if opts.FoldersFirst && a.IsDir != b.IsDir {
+		return a.IsDir
+	}
+	c := 0
+	switch opts.Sort {
+	case SORT_SIZE:
+		c = compareInt64(a.Size, b.Size)
+	case SORT_DATE:
+		c = compareInt64(a.ModTime, b.ModTime)
+	case SORT_TYPE:
+		c = strings.Compare(a.fileType(), b.fileType())
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if opts.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compareInt64(a int64, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+type listHeap struct {
+	opts  *ListOptions
+	items []*listItem
+}
+
+func (h *listHeap) Len() int           { return len(h.items) }
+func (h *listHeap) Less(i, j int) bool { return h.opts.less(h.items[j], h.items[i]) }
+func (h *listHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *listHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*listItem))
+}
+
+func (h *listHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items = h.items[:n-1]
+	return item
+}
+
+func encodeCursor(it *listItem) string {
+	b, _ := json.Marshal(it)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (*listItem, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor, err: %v", err)
+	}
+	it := &listItem{}
+	err = json.Unmarshal(b, it)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor, err: %v", err)
+	}
+	return it, nil
+}
@@ -0,0 +1,369 @@
+package fs
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	_ "golang.org/x/image/webp"
+)
+
+// Optional fields of FileMetadata
+const (
+	FIELD_MIME       = "mime"
+	FIELD_MODIFIED   = "modified"
+	FIELD_CREATED    = "created"
+	FIELD_ACCESSED   = "accessed"
+	FIELD_MODE       = "mode"
+	FIELD_OWNER      = "owner"
+	FIELD_CHECKSUM   = "checksum"
+	FIELD_DIMENSIONS = "dimensions"
+	FIELD_TAKEN      = "taken"
+)
+
+const MIME_FOLDER = "inode/directory"
+
+var allFields = []string{FIELD_MIME, FIELD_MODIFIED, FIELD_CREATED, FIELD_ACCESSED, FIELD_MODE, FIELD_OWNER, FIELD_CHECKSUM, FIELD_DIMENSIONS, FIELD_TAKEN}
+
+// Set of optional fields to fill in
+type Fields map[string]bool
+
+// Parse comma separated field names, "all" selects every field.
+func ParseFields(value string) (Fields, error) {
+	fields := Fields{}
+	for _, name := range utils.SplitRemoveEmpty(value, ',') {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			for _, f := range allFields {
+				fields[f] = true
+			}
+			continue
+		}
+		valid := false
+		for _, f := range allFields {
+			if f == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown field %s", name)
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// Check whether filling in the fields reads the content of files.
+func (fields Fields) ReadsContent() bool {
+	return fields[FIELD_MIME] || fields[FIELD_CHECKSUM] || fields[FIELD_DIMENSIONS] || fields[FIELD_TAKEN]
+}
+
+/*
+Fill in the selected optional fields of m for the file at fullPath.
+Sniffed mime type, dimensions and capture date read the file, they are cached until the file changes.
+Checksum is computed in background and left empty until it is cached.
+*/
+func (m *FileMetadata) Enrich(fullPath string, info os.FileInfo, fields Fields) {
+	if len(fields) == 0 {
+		return
+	}
+	if fields[FIELD_MODIFIED] {
+		m.Modified = formatTime(info.ModTime())
+	}
+	if fields[FIELD_CREATED] {
+		m.Created = formatTime(createdTime(fullPath, info))
+	}
+	if fields[FIELD_ACCESSED] {
+		m.Accessed = formatTime(accessedTime(info))
+	}
+	if fields[FIELD_MODE] {
+		m.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+	}
+	if fields[FIELD_OWNER] {
+		m.Owner = ownerName(info)
+	}
+
+	if info.IsDir() {
+		if fields[FIELD_MIME] {
+			m.Mime = MIME_FOLDER
+		}
+		return
+	}
+	if !fields.ReadsContent() {
+		return
+	}
+	details := contentCache.get(fullPath, info)
+	if fields[FIELD_MIME] {
+		m.Mime = details.mime(fullPath)
+	}
+	if fields[FIELD_CHECKSUM] {
+		m.Checksum = details.checksum(fullPath, info)
+	}
+	if fields[FIELD_DIMENSIONS] {
+		m.Width, m.Height = details.dimensions(fullPath)
+	}
+	if fields[FIELD_TAKEN] {
+		m.Taken = details.taken(fullPath)
+	}
+}
+
+// RFC3339 in UTC, empty for zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+var owners sync.Map
+
+func ownerName(info os.FileInfo) string {
+	uid, ok := ownerId(info)
+	if !ok {
+		return ""
+	}
+	if name, ok := owners.Load(uid); ok {
+		return name.(string)
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	u, err := user.LookupId(name)
+	if err == nil {
+		name = u.Username
+	}
+	owners.Store(uid, name)
+	return name
+}
+
+// details read from the content of a file, each computed on first use
+type fileDetails struct {
+	mu           sync.Mutex
+	mimeType     *string
+	sum          *string
+	sumQueued    bool
+	width        int
+	height       int
+	hasDimension bool
+	takenAt      *string
+}
+
+func (d *fileDetails) mime(fullPath string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mimeType == nil {
+		t := mime.TypeByExtension(path.Ext(fullPath))
+		if t == "" {
+			t = sniffType(fullPath)
+		}
+		d.mimeType = &t
+	}
+	return *d.mimeType
+}
+
+/*
+Cached checksum, queued for the checksum worker on first use so that a listing never hashes files.
+Checksums of files above the configured size are skipped.
+*/
+func (d *fileDetails) checksum(fullPath string, info os.FileInfo) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sum != nil {
+		return *d.sum
+	}
+	if info.Size() > config.ChecksumMaxSize {
+		sum := ""
+		d.sum = &sum
+		return sum
+	}
+	if !d.sumQueued {
+		d.sumQueued = queueChecksum(&checksumRequest{fullPath: fullPath, info: info, details: d})
+	}
+	return ""
+}
+
+// files waiting for a checksum, more are queued when they are listed again
+const checksumQueueSize = 1024
+
+type checksumRequest struct {
+	fullPath string
+	info     os.FileInfo
+	details  *fileDetails
+}
+
+var (
+	checksumQueue      = make(chan *checksumRequest, checksumQueueSize)
+	checksumWorkerOnce sync.Once
+)
+
+func queueChecksum(req *checksumRequest) bool {
+	checksumWorkerOnce.Do(func() {
+		go checksumWorker()
+	})
+	select {
+	case checksumQueue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// hash queued files one at a time, files changed since they were listed are skipped
+func checksumWorker() {
+	for req := range checksumQueue {
+		sum := ""
+		info, err := os.Stat(req.fullPath)
+		if err == nil && info.Size() == req.info.Size() && info.ModTime().Equal(req.info.ModTime()) {
+			sum, err = fileChecksum(req.fullPath)
+		}
+		req.details.mu.Lock()
+		if err == nil && sum != "" {
+			req.details.sum = &sum
+		}
+		req.details.sumQueued = false
+		req.details.mu.Unlock()
+	}
+}
+
+func (d *fileDetails) dimensions(fullPath string) (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hasDimension {
+		d.hasDimension = true
+		f, err := os.Open(fullPath)
+		if err == nil {
+			cfg, _, err := image.DecodeConfig(f)
+			if err == nil {
+				d.width, d.height = cfg.Width, cfg.Height
+			}
+			f.Close()
+		}
+	}
+	return d.width, d.height
+}
+
+func (d *fileDetails) taken(fullPath string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.takenAt == nil {
+		taken := ""
+		ext := strings.ToLower(path.Ext(fullPath))
+		if ext == ".jpg" || ext == ".jpeg" {
+			f, err := os.Open(fullPath)
+			if err == nil {
+				taken, _ = ReadExifDate(f)
+				f.Close()
+			}
+		}
+		d.takenAt = &taken
+	}
+	return *d.takenAt
+}
+
+func sniffType(fullPath string) string {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// sha256 of a file in hex
+func fileChecksum(fullPath string) (string, error) {
+	return FileChecksum(context.Background(), fullPath, nil)
+}
+
+/*
+Sha256 of a file in hex regardless of its size, stops once ctx is done.
+
+param:
+- onProgress: optional, called with the bytes read so far and the file size
+*/
+func FileChecksum(ctx context.Context, fullPath string, onProgress ProgressFunc) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	buf := make([]byte, 256<<10)
+	var read int64
+	for {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		read += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if onProgress != nil {
+			onProgress(read, info.Size(), fullPath)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// least recently used details of files, keyed by path, size and modification time
+type detailsCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	details *fileDetails
+}
+
+var contentCache = &detailsCache{
+	order:   list.New(),
+	entries: map[string]*list.Element{},
+}
+
+func (c *detailsCache) get(fullPath string, info os.FileInfo) *fileDetails {
+	key := fmt.Sprintf("%s|%d|%d", fullPath, info.Size(), info.ModTime().UnixNano())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).details
+	}
+	details := &fileDetails{}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, details: details})
+	for c.order.Len() > config.MetadataCacheSize && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return details
+}
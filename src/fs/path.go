@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+)
+
+// Return path relative to the public root, used in events and records instead of server paths.
+func PublicPath(fullPath string) string {
+	rel, err := filepath.Rel(config.PublicDirectoryRoot, fullPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path.Base(fullPath)
+	}
+	return path.Join("/", filepath.ToSlash(rel))
+}
+
+var ErrNotDirectory = fmt.Errorf("path component is not a directory")
+
+/*
+Create dirPath and its missing parents, dirPath must be under root which has to exist.
+Components are walked one by one from root, a file or a symbolic link on the way is an error
+so that a link never leads the new folders outside of root. An existing dirPath is left as it is.
+
+return:
+- topmost folder created, empty if dirPath already existed
+*/
+func MkdirUnder(root string, dirPath string) (string, error) {
+	rel, err := filepath.Rel(root, dirPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not under %s", dirPath, root)
+	}
+	if info, err := os.Stat(dirPath); err == nil && info.IsDir() {
+		return "", nil
+	}
+
+	created := ""
+	current := root
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		current = path.Join(current, name)
+		info, err := os.Lstat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return created, ErrNotDirectory
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return created, err
+		}
+		err = os.Mkdir(current, os.ModePerm)
+		if err != nil && !os.IsExist(err) {
+			return created, err
+		}
+		if err == nil && created == "" {
+			created = current
+		}
+	}
+	return created, nil
+}
@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+// Result of writing a tree
+type TreeStats struct {
+	Entries   int  `json:"entries"`
+	Truncated bool `json:"truncated"`
+}
+
+/*
+Write the tree under dirPath as json to w while walking it, so memory does not grow with the tree.
+Folders carry the size and number of files and folders of their whole subtree, their children are listed down to depth levels.
+Folders below depth are still walked for the totals.
+Walking stops after maxEntries entries, the totals are incomplete in that case and Truncated is set.
+
+A folder is written as
+{"name":"a","type":"Folder","date":"...","children":[...],"size":10,"files":2,"folders":1}
+*/
+func WriteTree(w io.Writer, dirPath string, depth int, maxEntries int) (*TreeStats, error) {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	tw := &treeWriter{
+		w:          bufio.NewWriter(w),
+		maxEntries: maxEntries,
+	}
+	tw.writeDir(dirPath, info, depth)
+	if tw.err != nil {
+		return nil, tw.err
+	}
+	return &TreeStats{Entries: tw.entries, Truncated: tw.truncated}, tw.w.Flush()
+}
+
+type treeWriter struct {
+	w          *bufio.Writer
+	maxEntries int
+	entries    int
+	truncated  bool
+	err        error
+}
+
+// totals of a subtree
+type treeTotals struct {
+	size    int64
+	files   int
+	folders int
+}
+
+// write a folder, children are written if depth > 0, return the totals of its subtree
+func (tw *treeWriter) writeDir(dirPath string, info os.FileInfo, depth int) *treeTotals {
+	totals := &treeTotals{}
+	tw.writeString(`{"name":`)
+	tw.writeJSON(info.Name())
+	tw.writeString(`,"type":"Folder","date":`)
+	tw.writeJSON(info.ModTime().Format(utils.GetDateFormatString()))
+	if depth > 0 {
+		tw.writeString(`,"children":[`)
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		// unreadable folders are listed as empty
+		log.Errorf("failed to read %s, err: %v", dirPath, err)
+	}
+	first := true
+	for _, entry := range entries {
+		if tw.err != nil || tw.truncated {
+			break
+		}
+		if IsInternal(path.Join(dirPath, entry.Name())) {
+			continue
+		}
+		if tw.entries >= tw.maxEntries {
+			tw.truncated = true
+			break
+		}
+		tw.entries++
+
+		entryInfo, err := entry.Info()
+		if err != nil {
+			// removed while walking
+			continue
+		}
+		if depth > 0 && !first {
+			tw.writeString(",")
+		}
+		first = false
+
+		if entry.IsDir() {
+			var sub *treeTotals
+			if depth > 0 {
+				sub = tw.writeDir(path.Join(dirPath, entry.Name()), entryInfo, depth-1)
+			} else {
+				sub = tw.sumDir(path.Join(dirPath, entry.Name()))
+			}
+			totals.size += sub.size
+			totals.files += sub.files
+			totals.folders += sub.folders + 1
+			continue
+		}
+
+		totals.size += entryInfo.Size()
+		totals.files++
+		if depth > 0 {
+			tw.writeString(`{"name":`)
+			tw.writeJSON(entryInfo.Name())
+			tw.writeString(`,"type":`)
+			tw.writeJSON(utils.GetFileExtension(entryInfo.Name()))
+			tw.writeString(`,"date":`)
+			tw.writeJSON(entryInfo.ModTime().Format(utils.GetDateFormatString()))
+			tw.writeString(`,"size":`)
+			tw.writeJSON(entryInfo.Size())
+			tw.writeString("}")
+		}
+	}
+
+	if depth > 0 {
+		tw.writeString("]")
+	}
+	tw.writeString(`,"size":`)
+	tw.writeJSON(totals.size)
+	tw.writeString(`,"files":`)
+	tw.writeJSON(totals.files)
+	tw.writeString(`,"folders":`)
+	tw.writeJSON(totals.folders)
+	tw.writeString("}")
+	return totals
+}
+
+// sum a folder below the listed depth without writing it
+func (tw *treeWriter) sumDir(dirPath string) *treeTotals {
+	totals := &treeTotals{}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		log.Errorf("failed to read %s, err: %v", dirPath, err)
+		return totals
+	}
+	for _, entry := range entries {
+		if tw.entries >= tw.maxEntries {
+			tw.truncated = true
+			break
+		}
+		if IsInternal(path.Join(dirPath, entry.Name())) {
+			continue
+		}
+		tw.entries++
+		if entry.IsDir() {
+			sub := tw.sumDir(path.Join(dirPath, entry.Name()))
+			totals.size += sub.size
+			totals.files += sub.files
+			totals.folders += sub.folders + 1
+			continue
+		}
+		entryInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		totals.size += entryInfo.Size()
+		totals.files++
+	}
+	return totals
+}
+
+func (tw *treeWriter) writeString(s string) {
+	if tw.err != nil {
+		return
+	}
+	_, tw.err = tw.w.WriteString(s)
+}
+
+func (tw *treeWriter) writeJSON(v interface{}) {
+	if tw.err != nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		tw.err = err
+		return
+	}
+	_, tw.err = tw.w.Write(b)
+}
@@ -1,107 +1,218 @@
 package fs
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/bandwidth"
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	"github.com/lyokalita/naspublic.ftserver/src/validate"
 )
 
-type FileUploader struct {
-	FileSize   int64
+// prefix of files being uploaded, they are left out of listings and search and clients cannot create such names
+const UPLOAD_TEMP_PREFIX = validate.UPLOAD_TEMP_PREFIX
+
+/*
+Writes a stream of unknown size, such as a part of a multipart request, to a new file.
+The stream goes to a temporary file in the destination folder, on the same filesystem,
+and the file appears under its name only once it is complete, so no partial file is ever visible
+and a file created meanwhile is never overwritten.
+*/
+type StreamUploader struct {
+	Reader     io.Reader
 	PartSize   int64
-	ReaderAt   io.ReaderAt
-	CancelChan <-chan int
+	OnProgress func(written int64)
+	Limiter    *bandwidth.Limiter
 }
 
-func NewFileUploader(inputFileReader io.ReaderAt, fileSize int64, partSize int64, cancelChannel <-chan int) *FileUploader {
-	return &FileUploader{
-		ReaderAt:   inputFileReader,
-		FileSize:   fileSize,
-		PartSize:   partSize,
-		CancelChan: cancelChannel,
+func NewStreamUploader(reader io.Reader, partSize int64) *StreamUploader {
+	return &StreamUploader{
+		Reader:   reader,
+		PartSize: partSize,
 	}
 }
 
-func (fw *FileUploader) WriteTo(destinationPath string) (int64, error) {
-	err := fw.setupDestinationFile(destinationPath)
-	if err != nil {
-		return 0, err
-	}
+/*
+Copy the stream to destinationPath, which must not exist.
 
-	f_out, err := os.OpenFile(destinationPath, os.O_WRONLY, 0644)
+return:
+- number of bytes written
+- os.ErrExist if destinationPath was created while copying
+*/
+func (su *StreamUploader) WriteTo(destinationPath string) (int64, error) {
+	tempPath, totalWriteSize, err := su.writeTemp(path.Dir(destinationPath))
 	if err != nil {
-		return 0, err
+		return totalWriteSize, err
 	}
-	defer f_out.Close()
-
-	totalWriteSize, err := fw.writeFile(f_out)
+	err = publish(tempPath, destinationPath)
 	if err != nil {
+		removeTemp(tempPath)
 		return totalWriteSize, err
 	}
-
-	if totalWriteSize != fw.FileSize {
-		return totalWriteSize, fmt.Errorf("final write size %d does not match inital file size %d", totalWriteSize, fw.FileSize)
-	}
-
-	log.Debug(utils.PrintMemUsage())
 	return totalWriteSize, nil
 }
 
-func (fw *FileUploader) setupDestinationFile(destinationPath string) error {
-	f, err := os.Create(destinationPath)
+/*
+Copy the stream to fileName in dir, a random suffix is added to the name while it is taken.
+
+return:
+- full path of the file
+- number of bytes written
+*/
+func (su *StreamUploader) WriteUnique(dir string, fileName string) (string, int64, error) {
+	tempPath, totalWriteSize, err := su.writeTemp(dir)
 	if err != nil {
-		return err
+		return "", totalWriteSize, err
 	}
-	f.Close()
-	err = os.Truncate(destinationPath, fw.FileSize)
-	if err != nil {
-		return err
+	name := fileName
+	for i := 0; i < 10; i++ {
+		destinationPath := path.Join(dir, name)
+		err = publish(tempPath, destinationPath)
+		if err == nil {
+			return destinationPath, totalWriteSize, nil
+		}
+		if !os.IsExist(err) {
+			break
+		}
+		name = utils.GetUniqueFileName(fileName)
+	}
+	removeTemp(tempPath)
+	if os.IsExist(err) {
+		err = fmt.Errorf("no free name for %s in %s", fileName, dir)
 	}
-	return nil
+	return "", totalWriteSize, err
 }
 
-func (fw *FileUploader) writeFile(w io.Writer) (int64, error) {
-	bufferedWriter := bufio.NewWriter(w)
-	var totalWriteSize int64 = 0
-	var offset int64 = 0
-	for ; offset < fw.FileSize; offset += fw.PartSize {
-		select {
-		case <-fw.CancelChan:
-			return totalWriteSize, fmt.Errorf("file writer is canceled")
-		default:
-			n, err := fw.writePart(bufferedWriter, offset)
-			if err != nil {
-				return totalWriteSize, err
-			}
-			totalWriteSize += int64(n)
+// stream into a new temporary file in dir, removed on failure
+func (su *StreamUploader) writeTemp(dir string) (string, int64, error) {
+	var f_out *os.File
+	var err error
+	tempPath := ""
+	for i := 0; i < 10; i++ {
+		tempPath = path.Join(dir, UPLOAD_TEMP_PREFIX+string(utils.GetRandomBytes(12)))
+		f_out, err = os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
 		}
 	}
-	err := bufferedWriter.Flush()
 	if err != nil {
-		return totalWriteSize, err
+		return "", 0, err
+	}
+
+	totalWriteSize, err := su.copy(f_out)
+	cerr := f_out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeTemp(tempPath)
+		return "", totalWriteSize, err
+	}
+	return tempPath, totalWriteSize, nil
+}
+
+const streamBufferSize = 256 << 10
+
+// copy the whole stream, progress is reported each time another PartSize bytes are written
+func (su *StreamUploader) copy(w io.Writer) (int64, error) {
+	pw := &progressWriter{w: su.Limiter.Writer(w), step: su.PartSize, onProgress: su.OnProgress}
+	totalWriteSize, err := io.CopyBuffer(pw, su.Reader, make([]byte, streamBufferSize))
+	if err == nil && su.OnProgress != nil {
+		su.OnProgress(totalWriteSize)
 	}
 	return totalWriteSize, err
 }
 
-func (fw *FileUploader) writePart(w *bufio.Writer, offset int64) (int, error) {
-	buffer := make([]byte, fw.PartSize)
-	readSize, err := fw.ReaderAt.ReadAt(buffer, offset)
-	if err != nil && err.Error() != "EOF" {
-		return 0, err
+type progressWriter struct {
+	w          io.Writer
+	step       int64
+	written    int64
+	reported   int64
+	onProgress func(written int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if pw.onProgress != nil && pw.written-pw.reported >= pw.step {
+		pw.reported = pw.written
+		pw.onProgress(pw.written)
+	}
+	return n, err
+}
+
+/*
+Give the complete temporary file its name without replacing an existing file.
+A hard link fails if the name is taken, filesystems without hard links fall back to a rename after a check.
+*/
+func publish(tempPath string, destinationPath string) error {
+	err := os.Link(tempPath, destinationPath)
+	if err == nil {
+		// the file is complete under its name, a leftover temp file is removed by PruneUploadTemp
+		removeTemp(tempPath)
+		return nil
 	}
-	if readSize != int(fw.PartSize) {
-		buffer = buffer[:readSize]
+	if os.IsExist(err) || !linkUnsupported(err) {
+		return err
 	}
-	writeSize, err := w.Write(buffer)
-	if err != nil {
-		return writeSize, err
+	_, err = os.Lstat(destinationPath)
+	if err == nil {
+		return os.ErrExist
 	}
-	if readSize != writeSize {
-		return writeSize, fmt.Errorf("write size %d does not match read size %d", writeSize, readSize)
+	return os.Rename(tempPath, destinationPath)
+}
+
+func linkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EMLINK)
+}
+
+func removeTemp(tempPath string) {
+	err := os.Remove(tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to clean file %s, err: %v", tempPath, err)
+	}
+}
+
+/*
+Remove temporary files of uploads cut short by a crash or a restart, i.e. last written before the given time.
+Uploads in progress keep writing to their file, so they are not removed.
+*/
+func PruneUploadTemp(root string, before time.Time) {
+	removed := 0
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			// removed while walking
+			return nil
+		}
+		if d.IsDir() {
+			if p != root && IsInternal(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(d.Name(), UPLOAD_TEMP_PREFIX) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			return nil
+		}
+		if os.Remove(p) == nil {
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("failed to prune upload temp files under %s, err: %v", root, err)
+		return
 	}
-	return writeSize, nil
+	log.Infof("pruned upload temp files, removed: %d", removed)
 }
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const benchPartSize = 1 << 20
+
+// endless stream of the same bytes, like a multipart part of the given size
+func benchReader(size int64) io.Reader {
+	return io.LimitReader(repeatReader('x'), size)
+}
+
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+/*
+Upload as done before streaming: the part is read whole into memory, as a parsed multipart form holds it,
+then written part by part with a new buffer each time.
+*/
+func bufferedUpload(r io.Reader, destinationPath string, partSize int64) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	readerAt := bytes.NewReader(data)
+	f, err := os.Create(destinationPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var total int64
+	for offset := int64(0); offset < int64(len(data)); offset += partSize {
+		buffer := make([]byte, partSize)
+		n, err := readerAt.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return total, err
+		}
+		written, err := w.Write(buffer[:n])
+		total += int64(written)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, w.Flush()
+}
+
+/*
+Throughput is reported as MB/s and the memory held by one upload as B/op:
+the buffered upload allocates the whole file, the stream uploader a fixed buffer.
+
+go test ./src/fs -run none -bench Upload -benchmem
+*/
+func BenchmarkUpload(b *testing.B) {
+	for _, size := range []int64{8 << 20, 64 << 20} {
+		b.Run(fmt.Sprintf("buffered/%dMB", size>>20), func(b *testing.B) {
+			dir := b.TempDir()
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				destinationPath := path.Join(dir, fmt.Sprintf("file%d", i))
+				_, err := bufferedUpload(benchReader(size), destinationPath, benchPartSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				os.Remove(destinationPath)
+			}
+		})
+		b.Run(fmt.Sprintf("stream/%dMB", size>>20), func(b *testing.B) {
+			dir := b.TempDir()
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				destinationPath := path.Join(dir, fmt.Sprintf("file%d", i))
+				_, err := NewStreamUploader(benchReader(size), benchPartSize).WriteTo(destinationPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				os.Remove(destinationPath)
+			}
+		})
+	}
+}
+
+func TestStreamUploaderDoesNotOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	destinationPath := path.Join(dir, "a.txt")
+	if err := os.WriteFile(destinationPath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewStreamUploader(bytes.NewReader([]byte("new")), benchPartSize).WriteTo(destinationPath)
+	if !os.IsExist(err) {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	b, _ := os.ReadFile(destinationPath)
+	if string(b) != "old" {
+		t.Fatalf("existing file overwritten with %q", b)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temp file left behind, entries: %d", len(entries))
+	}
+}
+
+func TestPruneUploadTemp(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(path.Join(root, "sub"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	old := path.Join(root, "sub", UPLOAD_TEMP_PREFIX+"old")
+	recent := path.Join(root, UPLOAD_TEMP_PREFIX+"recent")
+	kept := path.Join(root, "sub", "file.txt")
+	for _, p := range []string{old, recent, kept} {
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old, hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(kept, hourAgo, hourAgo)
+
+	PruneUploadTemp(root, time.Now().Add(-time.Minute))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("interrupted upload not removed, err: %v", err)
+	}
+	for _, p := range []string{recent, kept} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s removed, err: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "syscall"
+
+// Bytes available to unprivileged users on the filesystem of dirPath.
+func FreeSpace(dirPath string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dirPath, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,8 @@
+package health
+
+import "fmt"
+
+// Bytes available to unprivileged users on the filesystem of dirPath.
+func FreeSpace(dirPath string) (uint64, error) {
+	return 0, fmt.Errorf("free space check is not supported on windows")
+}
@@ -0,0 +1,95 @@
+package health
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+)
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Ok      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+var listening int32
+
+// Set by the http server once its listener is bound and cleared after shutdown.
+func SetListening(v bool) {
+	if v {
+		atomic.StoreInt32(&listening, 1)
+	} else {
+		atomic.StoreInt32(&listening, 0)
+	}
+}
+
+func IsListening() bool {
+	return atomic.LoadInt32(&listening) == 1
+}
+
+// Run all readiness checks, the server is ready only if all of them are ok.
+func Readiness() ([]*CheckResult, bool) {
+	results := []*CheckResult{
+		checkListener(),
+		checkWritable("public_directory", config.PublicDirectoryRoot),
+		checkWritable("temp_directory", config.TempDirectoryRoot),
+		checkFreeSpace("public_disk_space", config.PublicDirectoryRoot),
+		checkFreeSpace("temp_disk_space", config.TempDirectoryRoot),
+		checkSecrets(),
+	}
+	ready := true
+	for _, res := range results {
+		ready = ready && res.Ok
+	}
+	return results, ready
+}
+
+func checkListener() *CheckResult {
+	res := &CheckResult{Name: "listener", Ok: IsListening()}
+	if !res.Ok {
+		res.Message = "not listening"
+	}
+	return res
+}
+
+// check the directory is writable without creating files, a probe must not show up in the public directory
+func checkWritable(name string, dirPath string) *CheckResult {
+	res := &CheckResult{Name: name}
+	info, err := os.Stat(dirPath)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dirPath)
+	}
+	if err == nil {
+		err = Writable(dirPath)
+	}
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	res.Ok = true
+	return res
+}
+
+func checkFreeSpace(name string, dirPath string) *CheckResult {
+	res := &CheckResult{Name: name}
+	free, err := FreeSpace(dirPath)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	res.Ok = free >= config.MinFreeSpace
+	res.Message = fmt.Sprintf("%d bytes free", free)
+	return res
+}
+
+func checkSecrets() *CheckResult {
+	res := &CheckResult{Name: "secrets"}
+	if len(config.JwtSecret) == 0 || len(config.SignSecret) == 0 || config.AuthSecret == "" {
+		res.Message = "missing secrets"
+		return res
+	}
+	res.Ok = true
+	return res
+}
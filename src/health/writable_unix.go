@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "golang.org/x/sys/unix"
+
+// Check the server can create files in dirPath, a read-only filesystem fails too.
+func Writable(dirPath string) error {
+	return unix.Access(dirPath, unix.W_OK|unix.X_OK)
+}
@@ -0,0 +1,18 @@
+package health
+
+import (
+	"fmt"
+	"os"
+)
+
+// Check the server can create files in dirPath, only the read-only attribute is known on windows.
+func Writable(dirPath string) error {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return fmt.Errorf("%s is read-only", dirPath)
+	}
+	return nil
+}
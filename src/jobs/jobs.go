@@ -0,0 +1,315 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// finished jobs are kept for this long so that clients can fetch the result
+const jobRetention = time.Hour
+
+const queueSize = 1024
+
+/*
+Work executed by a job.
+
+return:
+- result: any json serializable value exposed to the job owner once done
+*/
+type Func func(ctx context.Context, job *Job) (interface{}, error)
+
+type Job struct {
+	mu        sync.Mutex
+	id        string
+	owner     string
+	kind      string
+	state     string
+	progress  int
+	result    interface{}
+	err       error
+	createdAt time.Time
+	updatedAt time.Time
+	ctx       context.Context
+	cancel    context.CancelFunc
+	run       Func
+}
+
+// Read-only copy of a job's state
+type Snapshot struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	State     string      `json:"state"`
+	Progress  int         `json:"progress"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt string      `json:"createdAt"`
+	UpdatedAt string      `json:"updatedAt"`
+}
+
+func (j *Job) Id() string {
+	return j.id
+}
+
+func (j *Job) Owner() string {
+	return j.owner
+}
+
+// Update progress in percentage, values out of [0, 100] are clamped.
+func (j *Job) SetProgress(percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = percent
+	j.updatedAt = time.Now()
+}
+
+func (j *Job) Snapshot() *Snapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := &Snapshot{
+		Id:        j.id,
+		Type:      j.kind,
+		State:     j.state,
+		Progress:  j.progress,
+		Result:    j.result,
+		CreatedAt: j.createdAt.Format(utils.GetDateFormatString()),
+		UpdatedAt: j.updatedAt.Format(utils.GetDateFormatString()),
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	return s
+}
+
+func (j *Job) isFinished() bool {
+	return j.state == JOB_DONE || j.state == JOB_FAILED || j.state == JOB_CANCELLED
+}
+
+// move job to a new state, return false if the job is already finished
+func (j *Job) transit(state string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.isFinished() {
+		return false
+	}
+	j.state = state
+	j.updatedAt = time.Now()
+	return true
+}
+
+// cancel a job that did not start yet, return false if it is running or finished
+func (j *Job) cancelQueued() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != JOB_QUEUED {
+		return false
+	}
+	j.state = JOB_CANCELLED
+	j.updatedAt = time.Now()
+	return true
+}
+
+func (j *Job) finish(result interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.isFinished() {
+		return
+	}
+	switch {
+	case j.ctx.Err() != nil && errors.Is(err, j.ctx.Err()):
+		// partial result of the work done before it stopped
+		j.state = JOB_CANCELLED
+		j.result = result
+	case err != nil:
+		j.state = JOB_FAILED
+		j.err = err
+	default:
+		j.state = JOB_DONE
+		j.result = result
+		j.progress = 100
+	}
+	j.updatedAt = time.Now()
+}
+
+type Manager struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan *Job
+	wg    sync.WaitGroup
+}
+
+var Default *Manager
+
+func Init() {
+	Default = NewManager(config.NumCore)
+	log.Debugf("successfully started job manager with %d workers", config.NumCore)
+}
+
+func NewManager(numWorkers int) *Manager {
+	if numWorkers <= 0 {
+		numWorkers = 1
+	}
+	m := &Manager{
+		jobs:  map[string]*Job{},
+		queue: make(chan *Job, queueSize),
+	}
+	for i := 0; i < numWorkers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+/*
+Queue a new job
+
+param:
+- owner: token id of the creator, only the owner can query or cancel the job
+- kind: job type shown to clients, e.g. "zip"
+*/
+func (m *Manager) Submit(owner string, kind string, run Func) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	job := &Job{
+		id:        string(utils.GetRandomBytes(16)),
+		owner:     owner,
+		kind:      kind,
+		state:     JOB_QUEUED,
+		createdAt: now,
+		updatedAt: now,
+		ctx:       ctx,
+		cancel:    cancel,
+		run:       run,
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- job:
+	default:
+		m.mu.Lock()
+		delete(m.jobs, job.id)
+		m.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("job queue is full")
+	}
+	log.Debugf("job %s (%s) queued for %s", job.id, kind, owner)
+	return job, nil
+}
+
+// Get a job owned by owner.
+func (m *Manager) Get(owner string, id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || job.owner != owner {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	return job, nil
+}
+
+/*
+Cancel a job owned by owner, finished jobs are left untouched.
+A queued job is cancelled right away, a running one keeps running until its function returns ctx.Err().
+*/
+func (m *Manager) Cancel(owner string, id string) (*Job, error) {
+	job, err := m.Get(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	job.cancel()
+	if job.cancelQueued() {
+		log.Debugf("job %s cancelled", id)
+	}
+	return job, nil
+}
+
+// Number of queued and running jobs.
+func (m *Manager) Pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, job := range m.jobs {
+		job.mu.Lock()
+		if !job.isFinished() {
+			n++
+		}
+		job.mu.Unlock()
+	}
+	return n
+}
+
+// Cancel all jobs and wait for the workers to exit.
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	for _, job := range m.jobs {
+		job.cancel()
+	}
+	m.mu.Unlock()
+	close(m.queue)
+	m.wg.Wait()
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for job := range m.queue {
+		if !job.transit(JOB_RUNNING) {
+			continue
+		}
+		result, err := m.runJob(job)
+		job.finish(result, err)
+		job.cancel()
+		switch job.Snapshot().State {
+		case JOB_CANCELLED:
+			log.Infof("job %s (%s) cancelled", job.id, job.kind)
+		case JOB_FAILED:
+			log.Errorf("job %s (%s) failed, err: %v", job.id, job.kind, err)
+		default:
+			log.Infof("job %s (%s) finished", job.id, job.kind)
+		}
+	}
+}
+
+func (m *Manager) runJob(job *Job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return job.run(job.ctx, job)
+}
+
+func (m *Manager) pruneLocked() {
+	deadline := time.Now().Add(-jobRetention)
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := job.isFinished() && job.updatedAt.Before(deadline)
+		job.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitState(t *testing.T, job *Job, state string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for job.Snapshot().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %s, got %s", state, job.Snapshot().State)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCancelRunningJobWaitsForFunction(t *testing.T) {
+	m := NewManager(1)
+	defer m.Stop()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	job, err := m.Submit("owner", "test", func(ctx context.Context, job *Job) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		<-release
+		return "partial", ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if _, err := m.Cancel("owner", job.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if state := job.Snapshot().State; state != JOB_RUNNING {
+		t.Fatalf("job reported %s while its function still runs", state)
+	}
+	close(release)
+	waitState(t, job, JOB_CANCELLED)
+	if job.Snapshot().Result != "partial" {
+		t.Fatalf("partial result lost: %v", job.Snapshot().Result)
+	}
+}
+
+func TestCancelIgnoredByFinishedWork(t *testing.T) {
+	m := NewManager(1)
+	defer m.Stop()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	job, _ := m.Submit("owner", "test", func(ctx context.Context, job *Job) (interface{}, error) {
+		close(started)
+		<-release
+		return "done", nil
+	})
+	<-started
+	m.Cancel("owner", job.Id())
+	close(release)
+
+	// the work completed, the cancel came too late
+	waitState(t, job, JOB_DONE)
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	m := NewManager(1)
+	defer m.Stop()
+
+	release := make(chan struct{})
+	m.Submit("owner", "blocker", func(ctx context.Context, job *Job) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	ran := make(chan struct{}, 1)
+	queued, _ := m.Submit("owner", "test", func(ctx context.Context, job *Job) (interface{}, error) {
+		ran <- struct{}{}
+		return nil, nil
+	})
+
+	if _, err := m.Cancel("owner", queued.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if state := queued.Snapshot().State; state != JOB_CANCELLED {
+		t.Fatalf("expected a queued job to be cancelled right away, got %s", state)
+	}
+	close(release)
+	select {
+	case <-ran:
+		t.Fatal("cancelled job was run")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := m.Cancel("other", queued.Id()); err == nil {
+		t.Fatal("job cancelled by another owner")
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/routine"
+	"github.com/lyokalita/naspublic.ftserver/src/semaphore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ftserver"
+
+var (
+	HttpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of http requests by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	HttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of http requests by handler, method and status code.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"handler", "method", "code"})
+
+	UploadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes written to disk by uploads.",
+	})
+
+	DownloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes sent to clients by downloads.",
+	})
+
+	ActiveUploads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_uploads",
+		Help:      "Number of uploads being written.",
+	})
+
+	ZipsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zip_jobs_in_flight",
+		Help:      "Number of zip archives being built.",
+	})
+
+	TokenValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validation_failures_total",
+		Help:      "Number of rejected jwt tokens by reason.",
+	}, []string{"reason"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		HttpRequests,
+		HttpDuration,
+		UploadedBytes,
+		DownloadedBytes,
+		ActiveUploads,
+		ZipsInFlight,
+		TokenValidationFailures,
+	)
+}
+
+// Register a gauge evaluated on every scrape.
+func RegisterGaugeFunc(name string, help string, f func() float64) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+// Register gauges of the size, units in use and waiters of a semaphore, labelled with its name.
+func RegisterSemaphore(name string, sem *semaphore.Semaphore) {
+	labels := prometheus.Labels{"semaphore": name}
+	gauges := map[string]func(semaphore.Stats) float64{
+		"semaphore_size":    func(st semaphore.Stats) float64 { return float64(st.Size) },
+		"semaphore_in_use":  func(st semaphore.Stats) float64 { return float64(st.InUse) },
+		"semaphore_waiters": func(st semaphore.Stats) float64 { return float64(st.Waiters) },
+	}
+	help := map[string]string{
+		"semaphore_size":    "Units of a semaphore.",
+		"semaphore_in_use":  "Units of a semaphore held.",
+		"semaphore_waiters": "Callers waiting for units of a semaphore.",
+	}
+	for metric, value := range gauges {
+		value := value
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        metric,
+			Help:        help[metric],
+			ConstLabels: labels,
+		}, func() float64 { return value(sem.Stats()) }))
+	}
+}
+
+/*
+Register a gauge reporting total size of files under dirPath.
+The folder is walked every interval in background for the lifetime of the process, scrapes read the last sample.
+*/
+func RegisterDirectorySize(name string, help string, dirPath string, interval time.Duration) {
+	var total int64
+	sample := func() {
+		atomic.StoreInt64(&total, directorySize(dirPath))
+	}
+	go sample()
+	routine.Every(interval, sample)
+	RegisterGaugeFunc(name, help, func() float64 {
+		return float64(atomic.LoadInt64(&total))
+	})
+}
+
+func directorySize(dirPath string) int64 {
+	var total int64 = 0
+	_ = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Wrap a handler to count requests and observe latencies under the handler name.
+func Instrument(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := middleware.NewResponseRecorder(rw)
+		next.ServeHTTP(recorder, r)
+		code := strconv.Itoa(recorder.Status)
+		HttpRequests.WithLabelValues(name, r.Method, code).Inc()
+		HttpDuration.WithLabelValues(name, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+type contextKey int
+
+const requestIdKey contextKey = 0
+
+// Wrap handler with middlewares, the first middleware is the outermost.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Return request id set by RequestId middleware, or empty string.
+func GetRequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey).(string)
+	return id
+}
+
+/*
+Assign a request id to every request, reuse the one from X-Request-Id header if it is sane.
+The id is stored in request context and echoed in the response header.
+*/
+func RequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !isValidRequestId(id) {
+			id = string(utils.GetRandomBytes(16))
+		}
+		rw.Header().Set(REQUEST_ID_HEADER, id)
+		ctx := context.WithValue(r.Context(), requestIdKey, id)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Write one line per request to logger in combined log format, followed by request id and duration:
+
+host - - [time] "method uri proto" status bytes "referer" "user agent" request_id duration_ms
+*/
+func AccessLog(logger log.LoggerInterface) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := NewResponseRecorder(rw)
+			next.ServeHTTP(recorder, r)
+			logger.Info(formatAccessLog(r, recorder, start))
+		})
+	}
+}
+
+func formatAccessLog(r *http.Request, recorder *ResponseRecorder, start time.Time) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %q %q %s %d",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method,
+		redactQuery(r),
+		r.Proto,
+		recorder.Status,
+		recorder.Bytes,
+		r.Referer(),
+		r.UserAgent(),
+		GetRequestId(r),
+		time.Since(start).Milliseconds(),
+	)
+}
+
+// hide credentials passed in query parameters, a dropbox share id is enough to upload
+func redactQuery(r *http.Request) string {
+	query := r.URL.Query()
+	redacted := false
+	for _, param := range []string{"token", "signed", "nc", "password", "dropbox"} {
+		if query.Get(param) != "" {
+			query.Set(param, "-")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return r.URL.RequestURI()
+	}
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// Recover from panics in handlers, log the stack and reply 500 if nothing was sent yet.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		recorder := NewResponseRecorder(rw)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Criticalf("panic in handler, request id: %s, %s %s, remote: %s, err: %v\n%s", GetRequestId(r), r.Method, r.URL.Path, r.RemoteAddr, err, debug.Stack())
+			if !recorder.WroteHeader() {
+				http.Error(recorder, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import "net/http"
+
+// ResponseWriter recording status code and body size
+type ResponseRecorder struct {
+	http.ResponseWriter
+	Status      int
+	Bytes       int64
+	wroteHeader bool
+}
+
+func NewResponseRecorder(rw http.ResponseWriter) *ResponseRecorder {
+	if rec, ok := rw.(*ResponseRecorder); ok {
+		return rec
+	}
+	return &ResponseRecorder{ResponseWriter: rw, Status: http.StatusOK}
+}
+
+func (rec *ResponseRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.Status = code
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *ResponseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.Bytes += int64(n)
+	return n, err
+}
+
+func (rec *ResponseRecorder) WroteHeader() bool {
+	return rec.wroteHeader
+}
+
+// Flush is required by Server-Sent Events handlers.
+func (rec *ResponseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
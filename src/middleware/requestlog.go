@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+
+	log "github.com/cihub/seelog"
+)
+
+// Logger of a request, every line is prefixed with the request id so that it can be matched with the access log.
+type RequestLogger struct {
+	prefix string
+}
+
+// Get the logger of a request, lines have no prefix if the request has no id.
+func RequestLog(r *http.Request) *RequestLogger {
+	return RequestLogById(GetRequestId(r))
+}
+
+// Get the logger of a request by its id, for work that goes on after the request is served.
+func RequestLogById(id string) *RequestLogger {
+	if id == "" {
+		return &RequestLogger{}
+	}
+	return &RequestLogger{prefix: "[" + id + "] "}
+}
+
+func (l *RequestLogger) Debugf(format string, params ...interface{}) {
+	log.Debugf(l.prefix+format, params...)
+}
+
+func (l *RequestLogger) Infof(format string, params ...interface{}) {
+	log.Infof(l.prefix+format, params...)
+}
+
+func (l *RequestLogger) Warnf(format string, params ...interface{}) error {
+	return log.Warnf(l.prefix+format, params...)
+}
+
+func (l *RequestLogger) Errorf(format string, params ...interface{}) error {
+	return log.Errorf(l.prefix+format, params...)
+}
+
+func (l *RequestLogger) Info(v ...interface{}) {
+	log.Info(l.with(v)...)
+}
+
+func (l *RequestLogger) Error(v ...interface{}) error {
+	return log.Error(l.with(v)...)
+}
+
+func (l *RequestLogger) with(v []interface{}) []interface{} {
+	if l.prefix == "" {
+		return v
+	}
+	return append([]interface{}{l.prefix}, v...)
+}
@@ -0,0 +1,241 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// buckets idle for this long are full again and can be dropped
+const idleBucketTimeout = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+Token bucket limiter keyed by string, each key gets burst tokens refilled at rate per second.
+A limiter with rate <= 0 allows everything.
+*/
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		lastPrune: time.Now(),
+	}
+}
+
+func (l *Limiter) Enabled() bool {
+	return l != nil && l.rate > 0
+}
+
+/*
+Take one token of key
+
+return:
+- whether the request is allowed
+- time to wait before a token is available if not allowed
+*/
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.pruneLocked(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *Limiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < idleBucketTimeout {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idleBucketTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limit requests of a route per client ip and per bearer token
+type RouteLimiter struct {
+	name  string
+	ip    *Limiter
+	token *Limiter
+}
+
+func NewRouteLimiter(name string, ipRate float64, ipBurst int, tokenRate float64, tokenBurst int) *RouteLimiter {
+	return &RouteLimiter{
+		name:  name,
+		ip:    NewLimiter(ipRate, ipBurst),
+		token: NewLimiter(tokenRate, tokenBurst),
+	}
+}
+
+func (rl *RouteLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// let cors preflight through, it carries no credential
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		ip := ClientIp(r)
+		if ok, wait := rl.ip.Allow(ip); !ok {
+			log.Errorf("rate limited %s by ip %s, retry after %v", rl.name, ip, wait)
+			TooManyRequests(rw, wait)
+			return
+		}
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			if ok, wait := rl.token.Allow(hashKey(authHeader)); !ok {
+				log.Errorf("rate limited %s by token, remote: %s, retry after %v", rl.name, ip, wait)
+				TooManyRequests(rw, wait)
+				return
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Reply 429 with Retry-After in whole seconds.
+func TooManyRequests(rw http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+}
+
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokens are not kept in memory in clear text
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+type failureRecord struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+/*
+Lock a key out for duration after maxFailures failures within window.
+*/
+type Lockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	records     map[string]*failureRecord
+}
+
+func NewLockout(maxFailures int, window time.Duration, duration time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		records:     map[string]*failureRecord{},
+	}
+}
+
+// Return remaining lockout time of key, 0 if not locked.
+func (lo *Lockout) Locked(key string) time.Duration {
+	if lo.maxFailures <= 0 {
+		return 0
+	}
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	rec, ok := lo.records[key]
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(rec.lockedUntil)
+	if remaining <= 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Record a failure of key, return error once the key gets locked.
+func (lo *Lockout) Failure(key string) error {
+	if lo.maxFailures <= 0 {
+		return nil
+	}
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	now := time.Now()
+	lo.pruneLocked(now)
+	rec, ok := lo.records[key]
+	if !ok || now.Sub(rec.first) > lo.window {
+		rec = &failureRecord{first: now}
+		lo.records[key] = rec
+	}
+	rec.failures++
+	if rec.failures >= lo.maxFailures {
+		rec.lockedUntil = now.Add(lo.duration)
+		return fmt.Errorf("%s locked out for %v after %d failures", key, lo.duration, rec.failures)
+	}
+	return nil
+}
+
+// Clear failures of key after a success.
+func (lo *Lockout) Success(key string) {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	rec, ok := lo.records[key]
+	if ok && time.Now().After(rec.lockedUntil) {
+		delete(lo.records, key)
+	}
+}
+
+func (lo *Lockout) pruneLocked(now time.Time) {
+	for key, rec := range lo.records {
+		if now.Sub(rec.first) > lo.window && now.After(rec.lockedUntil) {
+			delete(lo.records, key)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package routine
+
+import (
+	"time"
+)
+
+/*
+Run fn every interval in background until the returned stop is called.
+Runs never overlap, a slow run delays the next one. fn is never run if interval is not positive.
+*/
+func Every(interval time.Duration, fn func()) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	stopChan := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopChan)
+	}
+}
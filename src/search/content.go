@@ -0,0 +1,681 @@
+package search
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	nasfs "github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	contentSnapshotFile = "content.json"
+	contentJournalFile  = "content.log"
+)
+
+const (
+	minTermLength = 2
+	maxTermLength = 64
+	queueSize     = 1024
+	snippetBefore = 60
+	snippetAfter  = 140
+)
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Content index of text files, nil if content search is disabled
+var Content *ContentIndex
+
+// terms of a file, kept on disk so the inverted index can be rebuilt without reading files again
+type document struct {
+	Path    string         `json:"path"`
+	Size    int64          `json:"size"`
+	ModTime int64          `json:"modTime"`
+	Length  int            `json:"length"`
+	Terms   map[string]int `json:"terms"`
+}
+
+// change of the content index, appended to the journal
+type contentOp struct {
+	Op   string    `json:"op"`
+	Path string    `json:"path,omitempty"`
+	Doc  *document `json:"doc,omitempty"`
+}
+
+// A file matching a content search
+type ContentResult struct {
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+/*
+Inverted index of words in text files under root.
+Files are extracted by a background worker, so uploads are not slowed down by indexing.
+Like Index, the journal is folded into the snapshot at startup and once it grows over journalMax.
+*/
+type ContentIndex struct {
+	mu          sync.RWMutex
+	root        string
+	dir         string
+	maxSize     int64
+	extensions  map[string]bool
+	docs        map[string]*document
+	paths       []string // sorted paths of docs, a folder is a range of it
+	postings    map[string]map[string]int
+	totalLen    int64
+	journal     *os.File
+	journalSize int64
+	journalMax  int64
+	queue       chan string
+	syncing     int32
+	stopChan    chan struct{}
+	wg          sync.WaitGroup
+}
+
+func initContent() {
+	if !config.SearchContentEnabled {
+		return
+	}
+	idx, err := NewContentIndex(config.PublicDirectoryRoot, config.SearchContentDir, config.SearchContentMaxSize, config.SearchContentExtensions, config.SearchJournalMaxSize)
+	if err != nil {
+		log.Errorf("failed to load content index, err: %v", err)
+		return
+	}
+	Content = idx
+	log.Debugf("successfully loaded content index, dir: %s, documents: %d", config.SearchContentDir, idx.Len())
+}
+
+/*
+Load the content index of root from dir and start the extraction worker, files are synced in background if there is no snapshot.
+journalMax is the size in bytes of the journal over which it is folded into the snapshot, 0 for no limit.
+*/
+func NewContentIndex(root string, dir string, maxSize int64, extensions []string, journalMax int64) (*ContentIndex, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	idx := &ContentIndex{
+		root:       path.Join(root),
+		dir:        dir,
+		maxSize:    maxSize,
+		extensions: map[string]bool{},
+		docs:       map[string]*document{},
+		postings:   map[string]map[string]int{},
+		journalMax: journalMax,
+		queue:      make(chan string, queueSize),
+		stopChan:   make(chan struct{}),
+	}
+	for _, ext := range extensions {
+		idx.extensions[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))] = true
+	}
+
+	hasSnapshot := true
+	err = idx.readSnapshot()
+	if os.IsNotExist(err) {
+		hasSnapshot = false
+	} else if err != nil {
+		return nil, err
+	}
+	err = idx.replayJournal()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	idx.journal, err = os.OpenFile(path.Join(dir, contentJournalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := idx.journal.Stat()
+	if err != nil {
+		idx.journal.Close()
+		return nil, err
+	}
+	idx.journalSize = info.Size()
+	// without a snapshot the journal is cleared by the first sync instead
+	if hasSnapshot && idx.journalSize > 0 {
+		idx.compactLocked()
+	}
+
+	idx.wg.Add(1)
+	go idx.run()
+	if !hasSnapshot {
+		idx.wg.Add(1)
+		go func() {
+			defer idx.wg.Done()
+			idx.Sync()
+		}()
+	}
+	return idx, nil
+}
+
+func (idx *ContentIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// Queue fullPath for extraction if it is an indexed type, dropped if the queue is full since Sync catches up later.
+func (idx *ContentIndex) Enqueue(fullPath string) {
+	if !idx.isIndexed(fullPath) {
+		return
+	}
+	select {
+	case idx.queue <- path.Join(fullPath):
+	default:
+		log.Warnf("content index queue is full, skipped %s", fullPath)
+	}
+}
+
+// Queue every indexed file under fullPath.
+func (idx *ContentIndex) EnqueueTree(fullPath string) {
+	filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			idx.Enqueue(filepath.ToSlash(p))
+		}
+		return nil
+	})
+}
+
+// Remove fullPath and everything under it, only the documents under it are visited.
+func (idx *ContentIndex) Remove(fullPath string) {
+	idx.apply(&contentOp{Op: opRemove, Path: path.Join(fullPath)})
+}
+
+/*
+Bring the index up to date with the disk, only new or modified files are extracted.
+The snapshot is rewritten and the journal cleared at the end.
+A call while another sync is running returns right away.
+*/
+func (idx *ContentIndex) Sync() {
+	if !atomic.CompareAndSwapInt32(&idx.syncing, 0, 1) {
+		log.Info("content index sync already running, skipped")
+		return
+	}
+	defer atomic.StoreInt32(&idx.syncing, 0)
+
+	start := time.Now()
+	seen := map[string]bool{}
+	extracted := 0
+	err := filepath.WalkDir(idx.root, func(p string, d fs.DirEntry, err error) error {
+		select {
+		case <-idx.stopChan:
+			return io.EOF
+		default:
+		}
+		if err != nil {
+			return nil
+		}
+		if nasfs.IsInternal(p) {
+			return skipEntry(d)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		p = filepath.ToSlash(p)
+		if !idx.isIndexed(p) {
+			return nil
+		}
+		seen[p] = true
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		idx.mu.RLock()
+		doc, ok := idx.docs[p]
+		idx.mu.RUnlock()
+		if ok && doc.Size == info.Size() && doc.ModTime == info.ModTime().UnixNano() {
+			return nil
+		}
+		idx.extract(p)
+		extracted++
+		return nil
+	})
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to sync content index, err: %v", err)
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for p := range idx.docs {
+		if !seen[p] {
+			idx.removeLocked(p)
+		}
+	}
+	err = idx.writeSnapshotLocked()
+	if err != nil {
+		log.Errorf("failed to write content index, err: %v", err)
+		return
+	}
+	err = idx.journal.Truncate(0)
+	if err != nil {
+		log.Errorf("failed to clear content journal, err: %v", err)
+	} else {
+		idx.journalSize = 0
+	}
+	log.Infof("synced content index, documents: %d, extracted: %d, took: %v", len(idx.docs), extracted, time.Since(start))
+}
+
+/*
+Rank files under root by the words of query with BM25.
+Snippets read the files, so they are only built for the requested page.
+
+return:
+- results from offset with a snippet around the first matched word, at most limit
+- total number of matching files
+*/
+func (idx *ContentIndex) Search(root string, query string, offset int, limit int) ([]*ContentResult, int) {
+	terms := uniqueTerms(tokenize(query))
+	root = path.Join(root)
+
+	idx.mu.RLock()
+	scores := map[string]float64{}
+	n := float64(len(idx.docs))
+	avgLen := 1.0
+	if n > 0 && idx.totalLen > 0 {
+		avgLen = float64(idx.totalLen) / n
+	}
+	for _, term := range terms {
+		postings := idx.postings[term]
+		df := float64(len(postings))
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for p, tf := range postings {
+			if !isUnder(root, p) {
+				continue
+			}
+			docLen := float64(idx.docs[p].Length)
+			f := float64(tf)
+			scores[p] += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*docLen/avgLen))
+		}
+	}
+	idx.mu.RUnlock()
+
+	results := []*ContentResult{}
+	for p, score := range scores {
+		results = append(results, &ContentResult{Path: p, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	total := len(results)
+	if offset >= total {
+		return []*ContentResult{}, total
+	}
+	results = results[offset:]
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	for _, res := range results {
+		res.Snippet = idx.snippet(res.Path, terms)
+	}
+	return results, total
+}
+
+// Stop the worker and close the journal.
+func (idx *ContentIndex) Close() error {
+	close(idx.stopChan)
+	idx.wg.Wait()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.journal.Close()
+}
+
+func (idx *ContentIndex) run() {
+	defer idx.wg.Done()
+	for {
+		select {
+		case p := <-idx.queue:
+			idx.extract(p)
+		case <-idx.stopChan:
+			return
+		}
+	}
+}
+
+func (idx *ContentIndex) isIndexed(fullPath string) bool {
+	return idx.extensions[strings.ToLower(utils.GetFileExtension(path.Base(fullPath)))]
+}
+
+// read words of a text file into the index, binary files are skipped
+func (idx *ContentIndex) extract(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		idx.Remove(fullPath)
+		return
+	}
+	text, err := readText(fullPath, idx.maxSize)
+	if err != nil {
+		log.Warnf("failed to extract %s, err: %v", fullPath, err)
+		idx.Remove(fullPath)
+		return
+	}
+	doc := &document{
+		Path:    fullPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Terms:   map[string]int{},
+	}
+	for _, term := range tokenize(text) {
+		doc.Terms[term]++
+		doc.Length++
+	}
+	idx.apply(&contentOp{Op: opPut, Doc: doc})
+}
+
+func (idx *ContentIndex) apply(op *contentOp) {
+	b, err := json.Marshal(op)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.applyLocked(op)
+	n, err := idx.journal.Write(append(b, '\n'))
+	idx.journalSize += int64(n)
+	if err != nil {
+		log.Errorf("failed to write content journal, err: %v", err)
+	}
+	// a running sync writes the snapshot and clears the journal when it ends
+	if idx.journalMax > 0 && idx.journalSize >= idx.journalMax && atomic.LoadInt32(&idx.syncing) == 0 {
+		idx.compactLocked()
+	}
+}
+
+// write the documents as the snapshot and clear the journal, the journal is kept if the snapshot fails
+func (idx *ContentIndex) compactLocked() {
+	size := idx.journalSize
+	err := idx.writeSnapshotLocked()
+	if err != nil {
+		log.Errorf("failed to compact content journal, err: %v", err)
+		return
+	}
+	err = idx.journal.Truncate(0)
+	if err != nil {
+		log.Errorf("failed to clear content journal, err: %v", err)
+		return
+	}
+	idx.journalSize = 0
+	log.Infof("compacted content journal, size: %d, documents: %d", size, len(idx.docs))
+}
+
+func (idx *ContentIndex) applyLocked(op *contentOp) {
+	switch op.Op {
+	case opPut:
+		if op.Doc != nil {
+			idx.putLocked(op.Doc)
+		}
+	case opRemove:
+		idx.removeTreeLocked(op.Path)
+	}
+}
+
+func (idx *ContentIndex) putLocked(doc *document) {
+	if _, ok := idx.docs[doc.Path]; ok {
+		idx.dropLocked(doc.Path)
+	} else {
+		i := sort.SearchStrings(idx.paths, doc.Path)
+		idx.paths = append(idx.paths, "")
+		copy(idx.paths[i+1:], idx.paths[i:])
+		idx.paths[i] = doc.Path
+	}
+	idx.docs[doc.Path] = doc
+	idx.totalLen += int64(doc.Length)
+	for term, tf := range doc.Terms {
+		postings, ok := idx.postings[term]
+		if !ok {
+			postings = map[string]int{}
+			idx.postings[term] = postings
+		}
+		postings[doc.Path] = tf
+	}
+}
+
+func (idx *ContentIndex) removeLocked(p string) {
+	if _, ok := idx.docs[p]; !ok {
+		return
+	}
+	idx.dropLocked(p)
+	i := sort.SearchStrings(idx.paths, p)
+	idx.paths = append(idx.paths[:i], idx.paths[i+1:]...)
+}
+
+// remove dir and the documents under it, they follow dir+"/" in the sorted paths
+func (idx *ContentIndex) removeTreeLocked(dir string) {
+	idx.removeLocked(dir)
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = "/"
+	}
+	from := sort.SearchStrings(idx.paths, prefix)
+	to := from
+	for to < len(idx.paths) && strings.HasPrefix(idx.paths[to], prefix) {
+		idx.dropLocked(idx.paths[to])
+		to++
+	}
+	idx.paths = append(idx.paths[:from], idx.paths[to:]...)
+}
+
+// remove the document and its postings, paths is left to the caller
+func (idx *ContentIndex) dropLocked(p string) {
+	doc, ok := idx.docs[p]
+	if !ok {
+		return
+	}
+	for term := range doc.Terms {
+		postings := idx.postings[term]
+		delete(postings, p)
+		if len(postings) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLen -= int64(doc.Length)
+	delete(idx.docs, p)
+}
+
+// text around the first word of terms in the file
+func (idx *ContentIndex) snippet(fullPath string, terms []string) string {
+	text, err := readText(fullPath, idx.maxSize)
+	if err != nil {
+		return ""
+	}
+	lower := strings.ToLower(text)
+	pos := -1
+	for _, term := range terms {
+		i := indexWord(lower, term)
+		if i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	start := pos - snippetBefore
+	if start < 0 {
+		start = 0
+	}
+	end := pos + snippetAfter
+	if end > len(text) {
+		end = len(text)
+	}
+	// keep utf8 runes whole
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	s := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(text) {
+		s = s + "..."
+	}
+	return s
+}
+
+// position of term in text as a whole word, -1 if not found
+func indexWord(text string, term string) int {
+	offset := 0
+	for {
+		i := strings.Index(text[offset:], term)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[i+len(term):])
+		if (i == 0 || !isWordRune(before)) && (i+len(term) == len(text) || !isWordRune(after)) {
+			return i
+		}
+		offset = i + len(term)
+	}
+}
+
+// read at most maxSize bytes of a file, an error is returned for binary content
+func readText(fullPath string, maxSize int64) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxSize))
+	if err != nil {
+		return "", err
+	}
+	if strings.IndexByte(string(b), 0) >= 0 {
+		return "", errBinary
+	}
+	return strings.ToValidUTF8(string(b), ""), nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// lower case words of text, too short or too long words are dropped
+func tokenize(text string) []string {
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !isWordRune(r) }) {
+		n := utf8.RuneCountInString(word)
+		if n < minTermLength || n > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(word))
+	}
+	return terms
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+func (idx *ContentIndex) readSnapshot() error {
+	f, err := os.Open(path.Join(idx.dir, contentSnapshotFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		doc := &document{}
+		err = decoder.Decode(doc)
+		if err != nil {
+			return err
+		}
+		idx.putLocked(doc)
+	}
+	return nil
+}
+
+// a torn last line from a crash is skipped
+func (idx *ContentIndex) replayJournal() error {
+	f, err := os.Open(path.Join(idx.dir, contentJournalFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			op := &contentOp{}
+			if json.Unmarshal(line, op) != nil {
+				log.Warn("skipped broken content journal line")
+			} else {
+				idx.applyLocked(op)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write then rename so that a crash never leaves a partial snapshot
+func (idx *ContentIndex) writeSnapshotLocked() error {
+	tmp := path.Join(idx.dir, contentSnapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, doc := range idx.docs {
+		err = encoder.Encode(doc)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(idx.dir, contentSnapshotFile))
+}
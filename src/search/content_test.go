@@ -0,0 +1,54 @@
+package search
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestContentRemoveTree(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	// an empty snapshot so that no sync runs in background
+	if err := os.WriteFile(path.Join(dir, contentSnapshotFile), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewContentIndex(root, dir, 1<<20, []string{"txt"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// a-b sorts between a and a/, it must be kept
+	for _, name := range []string{"a/x.txt", "a/b/y.txt", "a-b/z.txt", "ab.txt", "c.txt"} {
+		p := path.Join(root, name)
+		os.MkdirAll(path.Dir(p), os.ModePerm)
+		if err := os.WriteFile(p, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		idx.extract(p)
+	}
+
+	idx.Remove(path.Join(root, "a"))
+	idx.Remove(path.Join(root, "c.txt"))
+
+	expected := []string{path.Join(root, "a-b/z.txt"), path.Join(root, "ab.txt")}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !reflect.DeepEqual(idx.paths, expected) {
+		t.Fatalf("expected paths %v, got %v", expected, idx.paths)
+	}
+	docs := []string{}
+	for p := range idx.docs {
+		docs = append(docs, p)
+	}
+	sort.Strings(docs)
+	if !reflect.DeepEqual(docs, expected) {
+		t.Fatalf("expected documents %v, got %v", expected, docs)
+	}
+	if len(idx.postings["hello"]) != 2 {
+		t.Fatalf("postings of removed documents kept: %v", idx.postings["hello"])
+	}
+}
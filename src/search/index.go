@@ -0,0 +1,477 @@
+package search
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	nasfs "github.com/lyokalita/naspublic.ftserver/src/fs"
+)
+
+const (
+	snapshotFile = "index.json"
+	journalFile  = "journal.log"
+)
+
+const (
+	opPut    = "put"
+	opRemove = "remove"
+)
+
+var errBinary = fmt.Errorf("binary content")
+
+// Index of the public directory, nil if search is disabled
+var Default *Index
+
+// A file or folder in the index
+type Entry struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	IsDir   bool   `json:"isDir,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+// change of the index, appended to the journal
+type journalOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path,omitempty"`
+	Entry *Entry `json:"entry,omitempty"`
+}
+
+/*
+Filter of a search, zero values match everything
+
+- Name: glob if it contains *, ? or [, otherwise a substring, case insensitive
+- MaxSize: 0 for no limit
+- Type: "file", "folder" or empty for both
+*/
+type Query struct {
+	Root    string
+	Name    string
+	MinSize int64
+	MaxSize int64
+	From    time.Time
+	To      time.Time
+	Type    string
+	Limit   int
+}
+
+/*
+Index of file names kept in memory and on disk.
+The disk copy is a snapshot written by Rebuild plus a journal of changes made since,
+so updates on upload or delete append one line instead of rewriting the index.
+The journal is folded into the snapshot at startup and once it grows over journalMax,
+so that it stays small when the periodic rebuild is disabled.
+*/
+type Index struct {
+	mu          sync.RWMutex
+	root        string
+	dir         string
+	entries     map[string]*Entry
+	journal     *os.File
+	journalSize int64
+	journalMax  int64
+	rebuilding  bool
+	pending     []*journalOp
+}
+
+func Init() {
+	if !config.SearchEnabled {
+		log.Info("search is disabled")
+		return
+	}
+	idx, err := NewIndex(config.PublicDirectoryRoot, config.SearchIndexDir, config.SearchJournalMaxSize)
+	if err != nil {
+		log.Errorf("failed to load search index, err: %v", err)
+		return
+	}
+	Default = idx
+	log.Debugf("successfully loaded search index, dir: %s, entries: %d", config.SearchIndexDir, idx.Len())
+	initContent()
+}
+
+/*
+Load the index of root from dir, the index is built in background if there is no snapshot.
+journalMax is the size in bytes of the journal over which it is folded into the snapshot, 0 for no limit.
+*/
+func NewIndex(root string, dir string, journalMax int64) (*Index, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		root:       root,
+		dir:        dir,
+		entries:    map[string]*Entry{},
+		journalMax: journalMax,
+	}
+
+	hasSnapshot := true
+	err = idx.readSnapshot()
+	if os.IsNotExist(err) {
+		hasSnapshot = false
+	} else if err != nil {
+		return nil, err
+	}
+	err = idx.replayJournal()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	idx.journal, err = os.OpenFile(path.Join(dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := idx.journal.Stat()
+	if err != nil {
+		idx.journal.Close()
+		return nil, err
+	}
+	idx.journalSize = info.Size()
+	// without a snapshot the journal is cleared by the first rebuild instead
+	if hasSnapshot && idx.journalSize > 0 {
+		idx.compactLocked()
+	}
+	if !hasSnapshot {
+		go func() {
+			err := idx.Rebuild()
+			if err != nil {
+				log.Errorf("failed to build search index, err: %v", err)
+			}
+		}()
+	}
+	return idx, nil
+}
+
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries)
+}
+
+// Add or refresh fullPath in the index.
+func (idx *Index) Put(fullPath string) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		idx.Remove(fullPath)
+		return
+	}
+	idx.apply(&journalOp{Op: opPut, Entry: newEntry(fullPath, info)})
+}
+
+// Add fullPath and everything under it.
+func (idx *Index) PutTree(fullPath string) {
+	err := filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		idx.apply(&journalOp{Op: opPut, Entry: newEntry(filepath.ToSlash(p), info)})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("failed to index %s, err: %v", fullPath, err)
+	}
+}
+
+// Remove fullPath and everything under it.
+func (idx *Index) Remove(fullPath string) {
+	idx.apply(&journalOp{Op: opRemove, Path: path.Join(fullPath)})
+}
+
+/*
+Walk the public directory and replace the index, then write a snapshot and clear the journal.
+Changes made while walking are kept.
+*/
+func (idx *Index) Rebuild() error {
+	idx.mu.Lock()
+	if idx.rebuilding {
+		idx.mu.Unlock()
+		return fmt.Errorf("search index is already rebuilding")
+	}
+	idx.rebuilding = true
+	idx.pending = nil
+	idx.mu.Unlock()
+	defer func() {
+		idx.mu.Lock()
+		idx.rebuilding = false
+		idx.pending = nil
+		idx.mu.Unlock()
+	}()
+
+	start := time.Now()
+	entries := map[string]*Entry{}
+	root := path.Join(idx.root)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Warnf("failed to index %s, err: %v", p, err)
+			return nil
+		}
+		p = filepath.ToSlash(p)
+		if p == root {
+			return nil
+		}
+		if nasfs.IsInternal(p) {
+			return skipEntry(d)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries[p] = newEntry(p, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, op := range idx.pending {
+		applyOp(entries, op)
+	}
+	idx.entries = entries
+	err = idx.writeSnapshotLocked()
+	if err != nil {
+		return err
+	}
+	err = idx.journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	idx.journalSize = 0
+	log.Infof("rebuilt search index, entries: %d, took: %v", len(entries), time.Since(start))
+	return nil
+}
+
+/*
+Find entries under query.Root matching the query, sorted by path.
+
+return:
+- matched entries, at most query.Limit
+- true if more entries matched
+*/
+func (idx *Index) Search(query *Query) ([]*Entry, bool) {
+	name := strings.ToLower(query.Name)
+	isGlob := strings.ContainsAny(name, "*?[")
+	root := path.Join(query.Root)
+
+	idx.mu.RLock()
+	matched := []*Entry{}
+	for p, entry := range idx.entries {
+		if p == root || !isUnder(root, p) {
+			continue
+		}
+		if !query.match(entry, name, isGlob) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	idx.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Path < matched[j].Path
+	})
+	if query.Limit > 0 && len(matched) > query.Limit {
+		return matched[:query.Limit], true
+	}
+	return matched, false
+}
+
+func (idx *Index) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.journal.Close()
+}
+
+func (query *Query) match(entry *Entry, name string, isGlob bool) bool {
+	if name != "" {
+		entryName := strings.ToLower(entry.Name)
+		if isGlob {
+			matched, _ := path.Match(name, entryName)
+			if !matched {
+				return false
+			}
+		} else if !strings.Contains(entryName, name) {
+			return false
+		}
+	}
+	if query.Type == "file" && entry.IsDir || query.Type == "folder" && !entry.IsDir {
+		return false
+	}
+	if (query.MinSize > 0 || query.MaxSize > 0) && entry.IsDir {
+		return false
+	}
+	if entry.Size < query.MinSize || query.MaxSize > 0 && entry.Size > query.MaxSize {
+		return false
+	}
+	if !query.From.IsZero() && entry.ModTime < query.From.Unix() {
+		return false
+	}
+	if !query.To.IsZero() && entry.ModTime > query.To.Unix() {
+		return false
+	}
+	return true
+}
+
+func (idx *Index) apply(op *journalOp) {
+	b, err := json.Marshal(op)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	applyOp(idx.entries, op)
+	if idx.rebuilding {
+		idx.pending = append(idx.pending, op)
+	}
+	n, err := idx.journal.Write(append(b, '\n'))
+	idx.journalSize += int64(n)
+	if err != nil {
+		log.Errorf("failed to write search journal, err: %v", err)
+	}
+	// a running rebuild writes the snapshot and clears the journal when it ends
+	if idx.journalMax > 0 && idx.journalSize >= idx.journalMax && !idx.rebuilding {
+		idx.compactLocked()
+	}
+}
+
+// write the entries as the snapshot and clear the journal, the journal is kept if the snapshot fails
+func (idx *Index) compactLocked() {
+	size := idx.journalSize
+	err := idx.writeSnapshotLocked()
+	if err != nil {
+		log.Errorf("failed to compact search journal, err: %v", err)
+		return
+	}
+	err = idx.journal.Truncate(0)
+	if err != nil {
+		log.Errorf("failed to clear search journal, err: %v", err)
+		return
+	}
+	idx.journalSize = 0
+	log.Infof("compacted search journal, size: %d, entries: %d", size, len(idx.entries))
+}
+
+func applyOp(entries map[string]*Entry, op *journalOp) {
+	switch op.Op {
+	case opPut:
+		if op.Entry != nil {
+			entries[op.Entry.Path] = op.Entry
+		}
+	case opRemove:
+		for p := range entries {
+			if isUnder(op.Path, p) {
+				delete(entries, p)
+			}
+		}
+	}
+}
+
+// p is dir or inside it
+func isUnder(dir string, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/") || dir == "/"
+}
+
+func newEntry(fullPath string, info os.FileInfo) *Entry {
+	entry := &Entry{
+		Path:    path.Join(fullPath),
+		Name:    info.Name(),
+		IsDir:   info.IsDir(),
+		ModTime: info.ModTime().Unix(),
+	}
+	if !entry.IsDir {
+		entry.Size = info.Size()
+	}
+	return entry
+}
+
+func (idx *Index) readSnapshot() error {
+	f, err := os.Open(path.Join(idx.dir, snapshotFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		entry := &Entry{}
+		err = decoder.Decode(entry)
+		if err != nil {
+			return err
+		}
+		idx.entries[entry.Path] = entry
+	}
+	return nil
+}
+
+// a torn last line from a crash is skipped
+func (idx *Index) replayJournal() error {
+	f, err := os.Open(path.Join(idx.dir, journalFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		op := &journalOp{}
+		err = json.Unmarshal(scanner.Bytes(), op)
+		if err != nil {
+			log.Warnf("skipped broken search journal line, err: %v", err)
+			continue
+		}
+		applyOp(idx.entries, op)
+	}
+	return scanner.Err()
+}
+
+// write then rename so that a crash never leaves a partial snapshot
+func (idx *Index) writeSnapshotLocked() error {
+	tmp := path.Join(idx.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, entry := range idx.entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(idx.dir, snapshotFile))
+}
+
+// skip an internal entry while walking, with everything under it for a folder
+func skipEntry(d fs.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
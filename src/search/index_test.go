@@ -0,0 +1,57 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func journalSize(t *testing.T, filePath string) int64 {
+	t.Helper()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestIndexJournalIsCompacted(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	// an empty snapshot so that no rebuild runs in background
+	if err := os.WriteFile(path.Join(dir, snapshotFile), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndex(root, dir, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// past the limit the journal is folded into the snapshot
+	for i := 0; i < 50; i++ {
+		p := path.Join(root, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		idx.Put(p)
+	}
+	if size := journalSize(t, path.Join(dir, journalFile)); size >= 1<<10 {
+		t.Fatalf("journal not compacted, size: %d", size)
+	}
+	idx.Remove(path.Join(root, "file0.txt"))
+	idx.Close()
+
+	// at startup the journal is replayed then cleared
+	idx, err = NewIndex(root, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if idx.Len() != 49 {
+		t.Fatalf("expected 49 entries, got %d", idx.Len())
+	}
+	if size := journalSize(t, path.Join(dir, journalFile)); size != 0 {
+		t.Fatalf("journal not cleared at startup, size: %d", size)
+	}
+}
@@ -1,34 +1,195 @@
 package semaphore
 
-import "sync"
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrInvalidCount = fmt.Errorf("semaphore: count must be positive")
+	ErrTooLarge     = fmt.Errorf("semaphore: count exceeds size")
+)
 
 type Semaphore struct {
-	c  chan int
-	wg sync.WaitGroup
+	mu      sync.Mutex
+	size    int64
+	cur     int64
+	waiters list.List
+	wg      sync.WaitGroup
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// Snapshot of the semaphore usage for monitoring
+type Stats struct {
+	Size    int64 `json:"size"`
+	InUse   int64 `json:"inUse"`
+	Waiters int   `json:"waiters"`
 }
 
 func New(n int) *Semaphore {
 	s := &Semaphore{
-		c:  make(chan int, n),
-		wg: sync.WaitGroup{},
+		size: int64(n),
 	}
 	return s
 }
 
-func (s *Semaphore) Acquire() {
-	s.wg.Add(1)
-	s.c <- 0
+// Acquire one unit, blocks until it is available, fails only if the semaphore has no unit at all.
+func (s *Semaphore) Acquire() error {
+	return s.AcquireN(context.Background(), 1)
+}
+
+// Acquire one unit, blocks until it is available or ctx is done.
+func (s *Semaphore) AcquireContext(ctx context.Context) error {
+	return s.AcquireN(ctx, 1)
+}
+
+/*
+Acquire n units, blocks until they are available or ctx is done.
+Waiters are served in FIFO order, a large request blocks the smaller ones queued after it.
+
+return:
+- ctx.Err() if ctx is done before acquisition, nothing is acquired in that case
+- ErrInvalidCount or ErrTooLarge right away if n can never be acquired
+*/
+func (s *Semaphore) AcquireN(ctx context.Context, n int64) error {
+	if n <= 0 {
+		return ErrInvalidCount
+	}
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.acquireLocked(n)
+		s.mu.Unlock()
+		return nil
+	}
+
+	if n > s.size {
+		s.mu.Unlock()
+		return ErrTooLarge
+	}
+
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(waiter{n: n, ready: ready})
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err := ctx.Err()
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// acquired right after cancellation, keep the units
+			err = nil
+		default:
+			isFront := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			// removing the front waiter may unblock the ones behind it
+			if isFront && s.size > s.cur {
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return err
+	case <-ready:
+		return nil
+	}
+}
+
+// Acquire one unit without blocking, return false if none is available.
+func (s *Semaphore) TryAcquire() bool {
+	return s.TryAcquireN(1)
 }
 
+// Acquire n units without blocking, return false if they are not available.
+func (s *Semaphore) TryAcquireN(n int64) bool {
+	if n <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.acquireLocked(n)
+		return true
+	}
+	return false
+}
+
+// Release one unit.
 func (s *Semaphore) Release() {
-	s.wg.Done()
-	<-s.c
+	s.ReleaseN(1)
+}
+
+// Release n units, panics if n is not positive or more units are released than held.
+func (s *Semaphore) ReleaseN(n int64) {
+	if n <= 0 {
+		panic("semaphore: released a non positive count")
+	}
+	s.mu.Lock()
+	s.cur -= n
+	if s.cur < 0 {
+		s.mu.Unlock()
+		panic("semaphore: released more than held")
+	}
+	s.wg.Add(-int(n))
+	s.notifyWaiters()
+	s.mu.Unlock()
 }
 
+// Wait until all acquired units are released.
 func (s *Semaphore) Wait() {
 	s.wg.Wait()
 }
 
+// Number of units in use.
 func (s *Semaphore) GetLen() int {
-	return len(s.c)
+	return int(s.InUse())
+}
+
+func (s *Semaphore) InUse() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+func (s *Semaphore) Waiters() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+func (s *Semaphore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Size:    s.size,
+		InUse:   s.cur,
+		Waiters: s.waiters.Len(),
+	}
+}
+
+func (s *Semaphore) acquireLocked(n int64) {
+	s.cur += n
+	s.wg.Add(int(n))
+}
+
+func (s *Semaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			break
+		}
+		w := next.Value.(waiter)
+		if s.size-s.cur < w.n {
+			// keep FIFO order so that large requests are not starved
+			break
+		}
+		s.acquireLocked(w.n)
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
 }
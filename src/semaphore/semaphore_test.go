@@ -0,0 +1,245 @@
+package semaphore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// wait until n callers are queued, the order they queue in is the order they are served in
+func waitForWaiters(t *testing.T, s *Semaphore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters, got %d", n, s.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcquireFifoOrder(t *testing.T) {
+	s := New(1)
+	if err := s.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	order := make([]int, 0, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.Acquire(); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			s.Release()
+		}(i)
+		waitForWaiters(t, s, i+1)
+	}
+
+	s.Release()
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("served out of order: %v", order)
+		}
+	}
+	if s.InUse() != 0 {
+		t.Fatalf("expected nothing in use, got %d", s.InUse())
+	}
+}
+
+func TestLargeWaiterBlocksSmallerOnes(t *testing.T) {
+	s := New(3)
+	if err := s.AcquireN(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	large := make(chan struct{})
+	go func() {
+		s.AcquireN(context.Background(), 3)
+		close(large)
+	}()
+	waitForWaiters(t, s, 1)
+
+	// one unit is free but the large request is first in line
+	if s.TryAcquire() {
+		t.Fatal("small acquisition went ahead of a queued one")
+	}
+
+	s.ReleaseN(2)
+	<-large
+	if s.InUse() != 3 {
+		t.Fatalf("expected 3 in use, got %d", s.InUse())
+	}
+	s.ReleaseN(3)
+}
+
+func TestAcquireCancel(t *testing.T) {
+	s := New(1)
+	s.Acquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.AcquireContext(ctx)
+	}()
+	waitForWaiters(t, s, 1)
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if s.Waiters() != 0 || s.InUse() != 1 {
+		t.Fatalf("cancelled waiter left state behind: %+v", s.Stats())
+	}
+	s.Release()
+	if !s.TryAcquire() {
+		t.Fatal("unit not available after release")
+	}
+	s.Release()
+}
+
+func TestCancelFrontWaiterUnblocksNext(t *testing.T) {
+	s := New(2)
+	s.Acquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	large := make(chan error)
+	go func() {
+		large <- s.AcquireN(ctx, 2)
+	}()
+	waitForWaiters(t, s, 1)
+
+	small := make(chan error)
+	go func() {
+		small <- s.Acquire()
+	}()
+	waitForWaiters(t, s, 2)
+
+	cancel()
+	if err := <-large; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	select {
+	case err := <-small:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter behind the cancelled one was not served")
+	}
+	s.ReleaseN(2)
+}
+
+func TestAcquireInvalidCount(t *testing.T) {
+	s := New(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := s.AcquireN(ctx, 3); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if err := s.AcquireN(ctx, 0); err != ErrInvalidCount {
+		t.Fatalf("expected ErrInvalidCount, got %v", err)
+	}
+	if err := s.AcquireN(ctx, -1); err != ErrInvalidCount {
+		t.Fatalf("expected ErrInvalidCount, got %v", err)
+	}
+	if err := New(0).Acquire(); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if s.Waiters() != 0 || s.InUse() != 0 {
+		t.Fatalf("failed acquisitions left state behind: %+v", s.Stats())
+	}
+}
+
+func TestTryAcquireN(t *testing.T) {
+	s := New(3)
+	if !s.TryAcquireN(2) {
+		t.Fatal("expected 2 units")
+	}
+	if s.TryAcquireN(2) {
+		t.Fatal("acquired more than the size")
+	}
+	if s.TryAcquireN(0) || s.TryAcquireN(-1) {
+		t.Fatal("acquired a non positive count")
+	}
+	if !s.TryAcquireN(1) {
+		t.Fatal("expected the last unit")
+	}
+	if s.TryAcquire() {
+		t.Fatal("acquired from a full semaphore")
+	}
+	s.ReleaseN(3)
+	if s.InUse() != 0 {
+		t.Fatalf("expected nothing in use, got %d", s.InUse())
+	}
+}
+
+func TestReleaseN(t *testing.T) {
+	s := New(4)
+	s.AcquireN(context.Background(), 4)
+
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+
+	s.ReleaseN(3)
+	stats := s.Stats()
+	if stats.InUse != 1 || stats.Size != 4 {
+		t.Fatalf("unexpected stats after release: %+v", stats)
+	}
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a unit is held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.Release()
+	<-waited
+
+	assertPanics(t, func() { s.Release() })
+	assertPanics(t, func() { s.ReleaseN(0) })
+}
+
+func TestConcurrentUse(t *testing.T) {
+	s := New(3)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int64) {
+			defer wg.Done()
+			if err := s.AcquireN(context.Background(), n); err != nil {
+				t.Error(err)
+				return
+			}
+			if in := s.InUse(); in > 3 {
+				t.Errorf("%d units in use", in)
+			}
+			s.ReleaseN(n)
+		}(int64(i%3 + 1))
+	}
+	wg.Wait()
+	if s.InUse() != 0 || s.Waiters() != 0 {
+		t.Fatalf("unexpected final state: %+v", s.Stats())
+	}
+}
+
+func assertPanics(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	f()
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+const defaultAuditQueryLimit = 1000
+
+type AuditHandler struct {
+}
+
+func NewAuditHandler() *AuditHandler {
+	return &AuditHandler{}
+}
+
+func (hdl *AuditHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Query audit records, admin only. Time range is in RFC3339, the latest records are returned if more than limit match.
+limit must be positive and is capped by config.
+
+GET /api/nas/v0/audit?token={token id}&path={path prefix}&from={start time}&to={end time}&limit={max records}
+*/
+func (hdl *AuditHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	err := ValidateAdminAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if audit.Default == nil {
+		logger.Error("audit log is not opened")
+		http.Error(rw, "Audit log unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Invalid query", http.StatusBadRequest)
+		return
+	}
+
+	records, err := audit.Default.Query(filter)
+	if err != nil {
+		logger.Errorf("failed to query audit log, err: %v", err)
+		http.Error(rw, "Failed to query audit log", http.StatusInternalServerError)
+		return
+	}
+
+	res := &AuditQueryResponse{Records: records}
+	res.ToJSON(rw)
+	logger.Infof("audit queried, filter: %+v, num records: %d, remote: %s", *filter, len(records), r.RemoteAddr)
+}
+
+func parseAuditFilter(r *http.Request) (*audit.Filter, error) {
+	filter := &audit.Filter{
+		TokenId: GetQueryParam("token", r),
+		Limit:   defaultAuditQueryLimit,
+	}
+	if prefix := GetQueryParam("path", r); prefix != "" {
+		filter.PathPrefix = path.Join("/", prefix)
+	}
+	var err error
+	if from := GetQueryParam("from", r); from != "" {
+		filter.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if to := GetQueryParam("to", r); to != "" {
+		filter.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit := GetQueryParam("limit", r); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Limit <= 0 {
+			return nil, audit.ErrInvalidLimit
+		}
+	}
+	if filter.Limit > config.AuditQueryMax {
+		filter.Limit = config.AuditQueryMax
+	}
+	return filter, nil
+}
+
+type AuditQueryResponse struct {
+	Records []*audit.Record `json:"records"`
+}
+
+func (p *AuditQueryResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
@@ -7,9 +7,10 @@ import (
 	"net/http"
 	"path"
 
-	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
 	"github.com/lyokalita/naspublic.ftserver/src/auth"
 	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
 	"github.com/lyokalita/naspublic.ftserver/src/validate"
 )
@@ -34,16 +35,11 @@ func (hdl *AuthHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 }
 
 func (hdl *AuthHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	token, err := GetTokenFromHeader(authHeader)
+	logger := middleware.RequestLog(r)
+	err := ValidateAdminAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
-		http.Error(rw, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-	if token != config.AuthSecret {
-		log.Error("token not correct")
-		http.Error(rw, "Invalid token", http.StatusUnauthorized)
+		logger.Error(err)
+		logAuditRecord(r, &audit.Record{Remote: r.RemoteAddr, Operation: audit.OP_TOKEN_CREATE, Outcome: audit.OUTCOME_DENIED, Error: err.Error()})
 		return
 	}
 
@@ -51,31 +47,33 @@ func (hdl *AuthHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
 	err = req.FromJSON(r.Body)
 	if err != nil {
 		http.Error(rw, "Invalid input", http.StatusBadRequest)
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
 	err = req.Validate()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadRequest)
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
-	tokenString, err := auth.GenerateJwtToken(req.Mode, req.Dir, req.Valid)
+	tokenString, err := auth.GenerateJwtToken(req.Mode, req.Dir, req.Valid, req.Bandwidth)
 	if err != nil {
 		http.Error(rw, "Failed to create token", http.StatusBadRequest)
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 	rw.Write([]byte(tokenString))
-	log.Infof("created new token for %v, remote: %s", *req, r.RemoteAddr)
+	logAuditRecord(r, &audit.Record{Remote: r.RemoteAddr, Operation: audit.OP_TOKEN_CREATE, Path: path.Join("/", req.Dir), Outcome: audit.OUTCOME_SUCCESS})
+	logger.Infof("created new token for %v, remote: %s", *req, r.RemoteAddr)
 }
 
 type TokenRequest struct {
-	Mode  string `json:"mode"`
-	Dir   string `json:"dir"`
-	Valid int64  `json:"valid"`
+	Mode      string `json:"mode"`
+	Dir       string `json:"dir"`
+	Valid     int64  `json:"valid"`
+	Bandwidth int64  `json:"bandwidth"`
 }
 
 func (p *TokenRequest) FromJSON(r io.Reader) error {
@@ -99,31 +97,39 @@ func (p *TokenRequest) Validate() error {
 	if p.Valid <= 0 {
 		return fmt.Errorf("invalid expiration period")
 	}
+
+	// validate bandwidth
+	if p.Bandwidth < 0 {
+		return fmt.Errorf("invalid bandwidth")
+	}
 	return nil
 }
 
 func (hdl *AuthHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
 	res := &AuthGetResponse{
-		Read:   fsPermission.AllowRead(),
-		Write:  fsPermission.AllowWrite(),
-		Delete: fsPermission.AllowDelete(),
-		ExpAt:  utils.ConvertUnixTimeToString(fsPermission.ExpAt()),
+		Read:      fsPermission.AllowRead(),
+		Write:     fsPermission.AllowWrite(),
+		Delete:    fsPermission.AllowDelete(),
+		ExpAt:     utils.ConvertUnixTimeToString(fsPermission.ExpAt()),
+		Bandwidth: fsPermission.Bandwidth(),
 	}
 	res.ToJSON(rw)
-	log.Info(fsPermission.String())
+	logger.Info(fsPermission.String())
 }
 
 type AuthGetResponse struct {
-	Read   bool
-	Write  bool
-	Delete bool
-	ExpAt  string
+	Read      bool
+	Write     bool
+	Delete    bool
+	ExpAt     string
+	Bandwidth int64
 }
 
 func (p *AuthGetResponse) ToJSON(w io.Writer) error {
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	"github.com/lyokalita/naspublic.ftserver/src/validate"
+	"github.com/lyokalita/naspublic.ftserver/src/webhook"
+)
+
+type BatchHandler struct {
+}
+
+func NewBatchHandler() *BatchHandler {
+	return &BatchHandler{}
+}
+
+func (hdl *BatchHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		hdl.handlePost(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Run delete, move, copy and mkdir operations in one request.
+Every operation is checked against the token before any is run, a single denied operation rejects the batch.
+With atomic set, the batch stops at the first failure and the operations already done are rolled back.
+Responds 200 if all operations succeed, 207 with per operation results otherwise.
+With async, the batch runs as a job and the same response is its result, a cancelled atomic batch is rolled back.
+
+POST /api/nas/v0/batch?async={true to run in a background job}
+body: {"atomic": false, "operations": [{"op": "move", "source": "/a", "target": "/b"}, {"op": "delete", "source": "/c"}, {"op": "mkdir", "target": "/d"}]}
+*/
+func (hdl *BatchHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	req := &BatchRequest{}
+	err = req.FromJSON(r.Body)
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > config.BatchMaxItems {
+		http.Error(rw, fmt.Sprintf("Number of operations must be between 1 and %d", config.BatchMaxItems), http.StatusBadRequest)
+		return
+	}
+
+	// check every operation before running any
+	ops := make([]*fs.BatchOperation, len(req.Operations))
+	for i, item := range req.Operations {
+		item.Source = cleanBatchPath(item.Source)
+		item.Target = cleanBatchPath(item.Target)
+		err = item.validate()
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		ops[i], err = item.authorize(fsPermission)
+		if err != nil {
+			logger.Infof("%s, err: %v", fsPermission.String(), err)
+			auditBatch(fsPermission, originOf(r), req.Operations, ops, nil, err)
+			http.Error(rw, fmt.Sprintf("No permission for operation %d", i), http.StatusForbidden)
+			return
+		}
+	}
+
+	if GetQueryParam("async", r) == "true" {
+		origin := originOf(r)
+		job, err := jobs.Default.Submit(fsPermission.Id(), "batch", func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			res := runBatch(ctx, fsPermission, origin, req, ops, func(done int) {
+				job.SetProgress(done * 100 / len(ops))
+			})
+			if ctx.Err() != nil && res.Failed > 0 {
+				return res, ctx.Err()
+			}
+			return res, nil
+		})
+		if err != nil {
+			logger.Errorf("failed to submit batch job, err: %v", err)
+			http.Error(rw, "Server busy", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		res := &JobResponse{job.Snapshot()}
+		res.ToJSON(rw)
+		logger.Infof("batch job %s of %d operations submitted by id: %s, remote: %s", job.Id(), len(ops), fsPermission.Id(), r.RemoteAddr)
+		return
+	}
+
+	res := runBatch(context.Background(), fsPermission, originOf(r), req, ops, nil)
+	rw.Header().Set("Content-Type", "application/json")
+	if res.Failed > 0 {
+		rw.WriteHeader(http.StatusMultiStatus)
+	}
+	res.ToJSON(rw)
+}
+
+// Run authorized operations, then refresh indexes, notify webhooks and write the audit record.
+func runBatch(ctx context.Context, fsPermission *auth.FsPermission, origin *requestOrigin, req *BatchRequest, ops []*fs.BatchOperation, onProgress func(done int)) *BatchResponse {
+	stagingDir := path.Join(config.BatchStagingDir, string(utils.GetRandomBytes(10)))
+	results := fs.RunBatch(ctx, ops, req.Atomic, stagingDir, onProgress)
+
+	res := &BatchResponse{Atomic: req.Atomic, Results: make([]*BatchItemResult, len(results))}
+	for i, result := range results {
+		item := req.Operations[i]
+		res.Results[i] = &BatchItemResult{Op: item.Op, Source: item.Source, Target: item.Target, Status: result.Status}
+		if result.Err != nil {
+			res.Results[i].Error = batchError(result.Err)
+		}
+		if result.Status == fs.BATCH_OK {
+			res.Succeeded++
+			batchApplied(fsPermission, origin, ops[i])
+		} else {
+			res.Failed++
+		}
+	}
+
+	var err error
+	if res.Failed > 0 {
+		err = fmt.Errorf("%d of %d operations not done", res.Failed, len(results))
+	}
+	auditBatch(fsPermission, origin, req.Operations, ops, results, err)
+	origin.logger().Infof("batch of %d operations, atomic: %v, failed: %d, id: %s, remote: %s", len(results), req.Atomic, res.Failed, fsPermission.Id(), origin.remote)
+	return res
+}
+
+// empty stays empty so that a missing path is not taken as the token root
+func cleanBatchPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Join(p)
+}
+
+// message of a failed operation without server paths
+func batchError(err error) string {
+	switch {
+	case err == fs.ErrTargetExists || err == fs.ErrIntoItself:
+		return err.Error()
+	case err == context.Canceled:
+		return "cancelled"
+	case os.IsNotExist(err):
+		return "source or parent folder does not exist"
+	case os.IsPermission(err):
+		return "permission denied by filesystem"
+	}
+	return "operation failed"
+}
+
+// refresh indexes and notify webhooks after an operation is done
+func batchApplied(fsPermission *auth.FsPermission, origin *requestOrigin, op *fs.BatchOperation) {
+	switch op.Op {
+	case fs.BATCH_DELETE:
+		pathRemoved(op.Source)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_DELETED, TokenId: fsPermission.Id(), Path: fs.PublicPath(op.Source), Remote: origin.remote})
+	case fs.BATCH_MOVE:
+		pathRemoved(op.Source)
+		treeChanged(op.Target)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_MOVED, TokenId: fsPermission.Id(), Source: fs.PublicPath(op.Source), Path: fs.PublicPath(op.Target), Remote: origin.remote})
+	case fs.BATCH_COPY:
+		treeChanged(op.Target)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_COPIED, TokenId: fsPermission.Id(), Source: fs.PublicPath(op.Source), Path: fs.PublicPath(op.Target), Remote: origin.remote})
+	case fs.BATCH_MKDIR:
+		pathChanged(op.Target)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_DIR_CREATED, TokenId: fsPermission.Id(), Path: fs.PublicPath(op.Target), Remote: origin.remote})
+	}
+}
+
+/*
+Write one audit record for the whole batch with public paths.
+results is nil when the batch is denied, ops are then only authorized up to the denied operation.
+*/
+func auditBatch(fsPermission *auth.FsPermission, origin *requestOrigin, items []*BatchItem, ops []*fs.BatchOperation, results []*fs.BatchResult, err error) {
+	rec := audit.NewRecord(fsPermission.Id(), origin.remote, audit.OP_BATCH, "", 0, err)
+	if results == nil {
+		rec.Outcome = audit.OUTCOME_DENIED
+	}
+	rec.Items = make([]*audit.RecordItem, len(items))
+	for i, item := range items {
+		var source, target string
+		if ops[i] != nil {
+			source, target = ops[i].Source, ops[i].Target
+		}
+		rec.Items[i] = &audit.RecordItem{
+			Operation: item.Op,
+			Path:      auditBatchPath(fsPermission, source, item.Source),
+			Target:    auditBatchPath(fsPermission, target, item.Target),
+		}
+		if results == nil {
+			continue
+		}
+		rec.Items[i].Outcome = results[i].Status
+		if results[i].Err != nil {
+			rec.Items[i].Error = results[i].Err.Error()
+		}
+	}
+	origin.audit(rec)
+}
+
+// public path of an operation path, resolved without checks when it was not authorized
+func auditBatchPath(fsPermission *auth.FsPermission, fullPath string, queryPath string) string {
+	if queryPath == "" {
+		return ""
+	}
+	if fullPath == "" {
+		fullPath = fsPermission.FullPath(queryPath)
+	}
+	return fs.PublicPath(fullPath)
+}
+
+type BatchRequest struct {
+	Atomic     bool         `json:"atomic"`
+	Operations []*BatchItem `json:"operations"`
+}
+
+func (p *BatchRequest) FromJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	return decoder.Decode(p)
+}
+
+type BatchItem struct {
+	Op     string `json:"op"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// check the fields required by the operation are given
+func (p *BatchItem) validate() error {
+	switch p.Op {
+	case fs.BATCH_DELETE:
+		if p.Source == "" {
+			return fmt.Errorf("source is required")
+		}
+	case fs.BATCH_MOVE, fs.BATCH_COPY:
+		if p.Source == "" || p.Target == "" {
+			return fmt.Errorf("source and target are required")
+		}
+	case fs.BATCH_MKDIR:
+		if p.Target == "" {
+			return fmt.Errorf("target is required")
+		}
+	default:
+		return fmt.Errorf("unknown op %s", p.Op)
+	}
+	if validate.HasReservedName(p.Target) {
+		return fmt.Errorf("target name is reserved")
+	}
+	return nil
+}
+
+/*
+Check permissions required by the operation, a move needs delete on the source and write on the target.
+
+return:
+- the operation on full paths
+*/
+func (p *BatchItem) authorize(fsPermission *auth.FsPermission) (*fs.BatchOperation, error) {
+	op := &fs.BatchOperation{Op: p.Op}
+	var err error
+	switch p.Op {
+	case fs.BATCH_DELETE:
+		op.Source, err = fsPermission.CheckDelete(p.Source)
+	case fs.BATCH_MOVE:
+		op.Source, err = fsPermission.CheckDelete(p.Source)
+		if err == nil {
+			op.Target, err = fsPermission.CheckWrite(p.Target)
+		}
+	case fs.BATCH_COPY:
+		op.Source, err = fsPermission.CheckRead(p.Source)
+		if err == nil {
+			op.Target, err = fsPermission.CheckWrite(p.Target)
+		}
+	case fs.BATCH_MKDIR:
+		op.Target, err = fsPermission.CheckWrite(p.Target)
+	}
+	return op, err
+}
+
+type BatchResponse struct {
+	Atomic    bool               `json:"atomic"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Results   []*BatchItemResult `json:"results"`
+}
+
+func (p *BatchResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
+
+type BatchItemResult struct {
+	Op     string `json:"op"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
@@ -1,14 +1,25 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 
-	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
 	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	"github.com/lyokalita/naspublic.ftserver/src/validate"
+	"github.com/lyokalita/naspublic.ftserver/src/webhook"
 )
 
 type DirHandler struct {
@@ -35,14 +46,27 @@ func (hdl *DirHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 }
 
 /*
-List all files and folders in a directory
+List files and folders in a directory, or the tree under it when depth or tree is given
 
-GET /api/nas/v0/dir?key={directory path}
+GET /api/nas/v0/dir?key={directory path}&depth={optional levels of children}&tree={optional true for all levels}
+
+Optional parameters of a flat listing
+- limit: entries per page, the response has nextCursor if there are more
+- cursor: nextCursor of the previous page
+- sort: name, size, date or type
+- order: asc or desc
+- foldersFirst: true to list folders before files
+- pattern: glob on names, e.g. IMG_*.jpg
+- ext: comma separated extensions, e.g. jpg,png
+- hidden: false to skip names starting with a dot
+- fields: comma separated optional metadata, mime, modified, created, accessed, mode, owner, checksum, dimensions, taken or all
+- fields reading file content cap the page size, checksums are computed in background and empty until ready
 */
 func (hdl *DirHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
@@ -52,7 +76,8 @@ func (hdl *DirHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 	// check permission and get full directory
 	fullQueryPath, err := fsPermission.CheckRead(queryDir)
 	if err != nil {
-		log.Errorf("%s, err: %v", fsPermission.String(), err)
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_LIST, queryDir, err)
 		http.Error(rw, "No permission", http.StatusForbidden)
 		return
 	}
@@ -60,15 +85,36 @@ func (hdl *DirHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 	// check directory exists
 	_, err = os.Stat(fullQueryPath)
 	if err != nil {
-		log.Errorf("directory %s does not exit, err: %v", fullQueryPath, err)
+		logger.Errorf("directory %s does not exit, err: %v", fullQueryPath, err)
+		auditOperation(fsPermission, r, audit.OP_LIST, fullQueryPath, 0, err)
 		http.Error(rw, "Directory does not exit", http.StatusNotFound)
 		return
 	}
 
+	// nested listing
+	depth, err := getTreeDepth(r)
+	if err != nil {
+		logger.Errorf("invalid depth, err: %v", err)
+		http.Error(rw, "Invalid depth", http.StatusBadRequest)
+		return
+	}
+	if depth > 0 {
+		hdl.writeTree(rw, r, fsPermission, queryDir, fullQueryPath, depth)
+		return
+	}
+
+	opts, err := getListOptions(r)
+	if err != nil {
+		logger.Errorf("invalid list options, err: %v", err)
+		http.Error(rw, "Invalid list options", http.StatusBadRequest)
+		return
+	}
+
 	// get file list in the directory
-	metadataList, err := fs.GetFileMetadataList(fullQueryPath)
+	metadataList, nextCursor, err := fs.ListFileMetadata(fullQueryPath, opts)
 	if err != nil {
-		log.Errorf("failed to list files, err: %v", err)
+		logger.Errorf("failed to list files, err: %v", err)
+		auditOperation(fsPermission, r, audit.OP_LIST, fullQueryPath, 0, err)
 		http.Error(rw, "Directory does not exit", http.StatusNotFound)
 		return
 	}
@@ -76,14 +122,89 @@ func (hdl *DirHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 	res := &ListFileResponse{
 		QueryFolder:  queryDir,
 		MetadataList: metadataList,
+		NextCursor:   nextCursor,
 	}
 	res.ToJSON(rw)
-	log.Infof("list full path: %s, query path: %s, num files: %d, remote: %s", fullQueryPath, res.QueryFolder, len(res.MetadataList), r.RemoteAddr)
+	auditOperation(fsPermission, r, audit.OP_LIST, fullQueryPath, 0, nil)
+	logger.Infof("list full path: %s, query path: %s, num files: %d, remote: %s", fullQueryPath, res.QueryFolder, len(res.MetadataList), r.RemoteAddr)
+}
+
+// stream the tree under fullQueryPath, the status cannot change once the body is started
+func (hdl *DirHandler) writeTree(rw http.ResponseWriter, r *http.Request, fsPermission *auth.FsPermission, queryDir string, fullQueryPath string, depth int) {
+	logger := middleware.RequestLog(r)
+	rw.Header().Set("Content-Type", "application/json")
+	queryFolder, _ := json.Marshal(queryDir)
+	fmt.Fprintf(rw, `{"queryFolder":%s,"depth":%d,"tree":`, queryFolder, depth)
+	stats, err := fs.WriteTree(rw, fullQueryPath, depth, config.TreeMaxEntries)
+	auditOperation(fsPermission, r, audit.OP_LIST, fullQueryPath, 0, err)
+	if err != nil {
+		logger.Errorf("failed to write tree of %s, err: %v", fullQueryPath, err)
+		return
+	}
+	fmt.Fprintf(rw, `,"entries":%d,"truncated":%t}`+"\n", stats.Entries, stats.Truncated)
+	logger.Infof("tree full path: %s, query path: %s, depth: %d, entries: %d, truncated: %t, remote: %s", fullQueryPath, queryDir, depth, stats.Entries, stats.Truncated, r.RemoteAddr)
+}
+
+// depth from query, 0 for a flat listing, capped by config
+func getTreeDepth(r *http.Request) (int, error) {
+	depth := 0
+	if GetQueryParam("tree", r) == "true" {
+		depth = config.TreeMaxDepth
+	}
+	if value := GetQueryParam("depth", r); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid depth %s", value)
+		}
+		depth = n
+	}
+	if depth > config.TreeMaxDepth {
+		depth = config.TreeMaxDepth
+	}
+	return depth, nil
+}
+
+// listing options from query, the page size is capped by config, and always set when fields read file content
+func getListOptions(r *http.Request) (*fs.ListOptions, error) {
+	opts := &fs.ListOptions{
+		Sort:         GetQueryParam("sort", r),
+		FoldersFirst: GetQueryParam("foldersFirst", r) == "true",
+		Pattern:      GetQueryParam("pattern", r),
+		HideHidden:   GetQueryParam("hidden", r) == "false",
+		Cursor:       GetQueryParam("cursor", r),
+	}
+	switch order := GetQueryParam("order", r); order {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return nil, fmt.Errorf("invalid order %s", order)
+	}
+	fields, err := fs.ParseFields(GetQueryParam("fields", r))
+	if err != nil {
+		return nil, err
+	}
+	opts.Fields = fields
+	if ext := GetQueryParam("ext", r); ext != "" {
+		opts.Extensions = utils.SplitRemoveEmpty(ext, ',')
+	}
+	if value := GetQueryParam("limit", r); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %s", value)
+		}
+		opts.Limit = n
+	}
+	if opts.Limit > config.DirPageMax || (opts.Limit == 0 && (opts.Cursor != "" || fields.ReadsContent())) {
+		opts.Limit = config.DirPageMax
+	}
+	return opts, opts.Validate()
 }
 
 type ListFileResponse struct {
 	QueryFolder  string             `json:"queryFolder"`
 	MetadataList []*fs.FileMetadata `json:"metadatas"`
+	NextCursor   string             `json:"nextCursor,omitempty"`
 }
 
 func (p *ListFileResponse) ToJSON(w io.Writer) error {
@@ -92,32 +213,45 @@ func (p *ListFileResponse) ToJSON(w io.Writer) error {
 }
 
 /*
-Create a directory
+Create a directory, with parents set missing parents are created and an existing directory is not an error
 
-POST /api/nas/v0/dir?key={directory path}
+POST /api/nas/v0/dir?key={directory path}&parents={optional true}
 */
 func (hdl *DirHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
 	queryDir := GetQueryParam("key", r)
 	queryDir = path.Join(queryDir)
+	if validate.HasReservedName(queryDir) {
+		logger.Infof("reserved folder name: %q", queryDir)
+		http.Error(rw, "Invalid folder name", http.StatusBadRequest)
+		return
+	}
 
 	// check permission and get full directory
 	fullQueryPath, err := fsPermission.CheckWrite(queryDir)
 	if err != nil {
-		log.Infof("%v, err: %v", *fsPermission, err)
+		logger.Infof("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_MKDIR, queryDir, err)
 		http.Error(rw, "No permission", http.StatusForbidden)
 		return
 	}
 
+	if GetQueryParam("parents", r) == "true" {
+		hdl.mkdirParents(rw, r, fsPermission, queryDir, fullQueryPath)
+		return
+	}
+
 	// check directory exists
 	_, err = os.Stat(fullQueryPath)
 	if err == nil {
-		log.Infof("directory %s already exists", fullQueryPath)
+		logger.Infof("directory %s already exists", fullQueryPath)
+		auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, os.ErrExist)
 		http.Error(rw, "Directory already exists", http.StatusConflict)
 		return
 	}
@@ -125,24 +259,57 @@ func (hdl *DirHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
 	// create a new folder
 	err = os.Mkdir(fullQueryPath, os.ModePerm)
 	if err != nil {
-		log.Errorf("Unable to create %s, err: ", queryDir, err)
+		logger.Errorf("unable to create %s, err: %v", queryDir, err)
+		auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, err)
+		http.Error(rw, "Unable to create folder", http.StatusNotFound)
+		return
+	}
+
+	pathChanged(fullQueryPath)
+	rw.Write([]byte(queryDir))
+	auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, nil)
+	webhook.Emit(&webhook.Event{Type: webhook.EVENT_DIR_CREATED, TokenId: fsPermission.Id(), Path: fs.PublicPath(fullQueryPath), Remote: r.RemoteAddr})
+	logger.Infof("directory created, query: %s, path: %s, remote: %s", queryDir, fullQueryPath, r.RemoteAddr)
+}
+
+// create the directory and missing parents within the token directory
+func (hdl *DirHandler) mkdirParents(rw http.ResponseWriter, r *http.Request, fsPermission *auth.FsPermission, queryDir string, fullQueryPath string) {
+	logger := middleware.RequestLog(r)
+	rootPath, _ := fsPermission.CheckWrite("/")
+	created, err := fs.MkdirUnder(rootPath, fullQueryPath)
+	if created != "" {
+		treeChanged(created)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_DIR_CREATED, TokenId: fsPermission.Id(), Path: fs.PublicPath(created), Remote: r.RemoteAddr})
+	}
+	if err == fs.ErrNotDirectory {
+		logger.Infof("unable to create %s, a file is on the way", fullQueryPath)
+		auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, err)
+		http.Error(rw, "A file exists on the path", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Errorf("unable to create %s, err: %v", queryDir, err)
+		auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, err)
 		http.Error(rw, "Unable to create folder", http.StatusNotFound)
 		return
 	}
 
 	rw.Write([]byte(queryDir))
-	log.Infof("directory created, query: %s, path: %s, remote: %s", queryDir, fullQueryPath, r.RemoteAddr)
+	auditOperation(fsPermission, r, audit.OP_MKDIR, fullQueryPath, 0, nil)
+	logger.Infof("directory created with parents, query: %s, path: %s, first created: %s, remote: %s", queryDir, fullQueryPath, created, r.RemoteAddr)
 }
 
 /*
-Delete a target
+Delete a target, a folder is deleted with everything under it.
+With async, the deletion runs as a job and the deleted path is its result.
 
-DELETE /api/nas/v0/dir?key={target path}
+DELETE /api/nas/v0/dir?key={target path}&async={true to delete in a background job}
 */
 func (hdl *DirHandler) handleDelete(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
@@ -152,7 +319,8 @@ func (hdl *DirHandler) handleDelete(rw http.ResponseWriter, r *http.Request) {
 	// check permission and get full directory
 	fullQueryPath, err := fsPermission.CheckDelete(queryPath)
 	if err != nil {
-		log.Infof("%v, err: %v", *fsPermission, err)
+		logger.Infof("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_DELETE, queryPath, err)
 		http.Error(rw, "No permission", http.StatusForbidden)
 		return
 	}
@@ -160,19 +328,64 @@ func (hdl *DirHandler) handleDelete(rw http.ResponseWriter, r *http.Request) {
 	// check path exists
 	_, err = os.Stat(fullQueryPath)
 	if err != nil {
-		log.Infof("path %s does not exit, err: %v", fullQueryPath, err)
+		logger.Infof("path %s does not exit, err: %v", fullQueryPath, err)
+		auditOperation(fsPermission, r, audit.OP_DELETE, fullQueryPath, 0, err)
 		http.Error(rw, "Target not exist", http.StatusNotFound)
 		return
 	}
 
-	// remove target path
-	err = os.RemoveAll(fullQueryPath)
+	if GetQueryParam("async", r) == "true" {
+		origin := originOf(r)
+		job, err := jobs.Default.Submit(fsPermission.Id(), "delete", func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			err := deleteTarget(ctx, fsPermission, origin, queryPath, fullQueryPath)
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return nil, err
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to delete %s", queryPath)
+			}
+			return queryPath, nil
+		})
+		if err != nil {
+			logger.Errorf("failed to submit delete job, err: %v", err)
+			http.Error(rw, "Server busy", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		res := &JobResponse{job.Snapshot()}
+		res.ToJSON(rw)
+		logger.Infof("delete job %s submitted by id: %s, query: %s, remote: %s", job.Id(), fsPermission.Id(), queryPath, r.RemoteAddr)
+		return
+	}
+
+	err = deleteTarget(context.Background(), fsPermission, originOf(r), queryPath, fullQueryPath)
 	if err != nil {
-		log.Errorf("failed to delete %s, err: ", fullQueryPath, err)
 		http.Error(rw, "Cannot find object", http.StatusNotFound)
 		return
 	}
-
 	rw.Write([]byte(queryPath))
-	log.Infof("deleted query: %s, path: %s, remote: %s", queryPath, fullQueryPath, r.RemoteAddr)
+}
+
+/*
+Remove fullQueryPath and everything under it, then refresh indexes, audit and notify webhooks.
+The removal stops once ctx is done, what is left of the target is indexed again.
+*/
+func deleteTarget(ctx context.Context, fsPermission *auth.FsPermission, origin *requestOrigin, queryPath string, fullQueryPath string) error {
+	logger := origin.logger()
+	err := fs.RemoveAll(ctx, fullQueryPath)
+	if err != nil {
+		logger.Errorf("failed to delete %s, err: %v", fullQueryPath, err)
+		origin.auditOperation(fsPermission, audit.OP_DELETE, fullQueryPath, 0, err)
+		pathRemoved(fullQueryPath)
+		if _, serr := os.Lstat(fullQueryPath); serr == nil {
+			treeChanged(fullQueryPath)
+		}
+		return err
+	}
+
+	pathRemoved(fullQueryPath)
+	origin.auditOperation(fsPermission, audit.OP_DELETE, fullQueryPath, 0, nil)
+	webhook.Emit(&webhook.Event{Type: webhook.EVENT_DELETED, TokenId: fsPermission.Id(), Path: fs.PublicPath(fullQueryPath), Remote: origin.remote})
+	logger.Infof("deleted query: %s, path: %s, remote: %s", queryPath, fullQueryPath, origin.remote)
+	return nil
 }
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/watch"
+)
+
+type DirWatchHandler struct {
+}
+
+func NewDirWatchHandler() *DirWatchHandler {
+	return &DirWatchHandler{}
+}
+
+func (hdl *DirWatchHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Stream changes of files and folders in a directory as Server-Sent Events
+
+GET /api/nas/v0/dir/watch?key={directory path}&token={optional jwt token if Authorization header cannot be set}
+*/
+func (hdl *DirWatchHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorizationForStream(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if watch.Default == nil {
+		logger.Error("directory watcher is not running")
+		http.Error(rw, "Directory watching is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	queryDir := GetQueryParam("key", r)
+	queryDir = path.Join(queryDir)
+
+	// check permission and get full directory
+	fullQueryPath, err := fsPermission.CheckRead(queryDir)
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	// check directory exists
+	info, err := os.Stat(fullQueryPath)
+	if err != nil || !info.IsDir() {
+		logger.Errorf("directory %s does not exit, err: %v", fullQueryPath, err)
+		http.Error(rw, "Directory does not exit", http.StatusNotFound)
+		return
+	}
+
+	stream, err := NewSSEWriter(rw)
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	eventChan, unsubscribe := watch.Default.Subscribe(fullQueryPath)
+	defer unsubscribe()
+	logger.Infof("watch opened, full path: %s, query path: %s, remote: %s", fullQueryPath, queryDir, r.RemoteAddr)
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-eventChan:
+			err = stream.Send(e.Type, &DirWatchEvent{
+				Type:        e.Type,
+				Name:        filepath.Base(e.FullPath),
+				QueryFolder: queryDir,
+				IsDir:       e.IsDir,
+			})
+		case <-heartbeat.C:
+			err = stream.Heartbeat()
+		case <-r.Context().Done():
+			logger.Infof("watch closed, query path: %s, remote: %s", queryDir, r.RemoteAddr)
+			return
+		}
+		if err != nil {
+			logger.Errorf("failed to write watch stream, query path: %s, err: %v", queryDir, err)
+			return
+		}
+	}
+}
+
+type DirWatchEvent struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	QueryFolder string `json:"queryFolder"`
+	IsDir       bool   `json:"isDir"`
+}
@@ -1,17 +1,29 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
 	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/bandwidth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/events"
 	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
 	"github.com/lyokalita/naspublic.ftserver/src/routine"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+	"github.com/lyokalita/naspublic.ftserver/src/webhook"
 )
 
 type DownloadHandler struct {
@@ -34,12 +46,18 @@ func (hdl *DownloadHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 }
 
 /*
-Download a file
+Download a file, files of inline keys are shown in the browser and support range requests
 
-GET /api/nas/v0/download?key={file path}
+GET /api/nas/v0/download?signed={signed key}&nc={nonce}
 */
 func (hdl *DownloadHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
-	log.Debugf("handle file download request, remote: %s", r.RemoteAddr)
+	logger := middleware.RequestLog(r)
+	logger.Debugf("handle file download request, remote: %s", r.RemoteAddr)
+	err := CheckLockout(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
 
 	// get query parameter
 	signed := GetQueryParam("signed", r)
@@ -48,7 +66,9 @@ func (hdl *DownloadHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 	// validate signed key
 	metadata, err := auth.DLSigning.Validate(signed, nonce)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
+		RecordAuthFailure(r)
+		logAuditRecord(r, &audit.Record{Remote: r.RemoteAddr, Operation: audit.OP_DOWNLOAD, Outcome: audit.OUTCOME_DENIED, Error: err.Error()})
 		http.Error(rw, "Invalid signed key", http.StatusUnauthorized)
 		return
 	}
@@ -56,7 +76,11 @@ func (hdl *DownloadHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 	// check file exists
 	info, err := os.Stat(metadata.FilePath)
 	if err != nil || info.IsDir() {
-		log.Errorf("file does not exist, %s, err: %v", metadata.FilePath, err)
+		logger.Errorf("file does not exist, %s, err: %v", metadata.FilePath, err)
+		if err == nil {
+			err = fmt.Errorf("%s is a directory", metadata.FilePath)
+		}
+		logAuditRecord(r, audit.NewRecord(metadata.TokenId, r.RemoteAddr, audit.OP_DOWNLOAD, fs.PublicPath(metadata.FilePath), 0, err))
 		http.Error(rw, "File does not exist", http.StatusNotFound)
 		return
 	}
@@ -66,16 +90,78 @@ func (hdl *DownloadHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// a share download counts once anything is served for its key
+	if metadata.Slot != "" && (share.Default == nil || !share.Default.UseSlot(metadata.Slot)) {
+		logger.Errorf("share download slot of %s is no longer valid", metadata.TokenId)
+		logAuditRecord(r, audit.NewRecord(metadata.TokenId, r.RemoteAddr, audit.OP_DOWNLOAD, fs.PublicPath(metadata.FilePath), 0, share.ErrExhausted))
+		http.Error(rw, "Share expired", http.StatusGone)
+		return
+	}
+
 	// send file
-	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(metadata.FilePath)))
-	http.ServeFile(rw, r, metadata.FilePath)
-	log.Infof("file served: %s", metadata.FilePath)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	recorder := middleware.NewResponseRecorder(rw)
+	limiter := bandwidth.Default.For(r.Context(), metadata.TokenId, metadata.Bandwidth)
+	if metadata.Inline {
+		err = serveInline(limiter.ResponseWriter(recorder), r, metadata.FilePath, info)
+		if err != nil {
+			logger.Errorf("failed to serve %s, err: %v", metadata.FilePath, err)
+			logAuditRecord(r, audit.NewRecord(metadata.TokenId, r.RemoteAddr, audit.OP_DOWNLOAD, fs.PublicPath(metadata.FilePath), 0, err))
+			http.Error(rw, "File does not exist", http.StatusNotFound)
+			return
+		}
+	} else {
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path.Base(metadata.FilePath)))
+		http.ServeFile(limiter.ResponseWriter(recorder), r, metadata.FilePath)
+	}
+	metrics.DownloadedBytes.Add(float64(recorder.Bytes))
+	logAuditRecord(r, audit.NewRecord(metadata.TokenId, r.RemoteAddr, audit.OP_DOWNLOAD, fs.PublicPath(metadata.FilePath), recorder.Bytes, nil))
+	logger.Infof("file served: %s", metadata.FilePath)
 }
 
+// inline files are always served in a sandbox, a browser may run scripts of a sniffed or mislabelled type
+const sandboxPolicy = "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+/*
+Serve a file to be shown by the browser.
+The type is taken from the extension, or sniffed from the content if the extension is unknown.
+Range requests are answered by http.ServeContent.
+*/
+func serveInline(rw http.ResponseWriter, r *http.Request, filePath string, info os.FileInfo) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		contentType = http.DetectContentType(buf[:n])
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	rw.Header().Set("Content-Security-Policy", sandboxPolicy)
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": info.Name()}))
+	http.ServeContent(rw, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+/*
+Sign a download url for files, multiple files or folders are zipped first.
+An inline url of a single file can be opened in the browser repeatedly for download.inline_ttl_sec, at most until the token expires.
+
+POST /api/nas/v0/download?async={true to zip in a background job}&op={optional operation id for progress events}&inline={true for an inline url}
+*/
 func (hdl *DownloadHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
@@ -84,7 +170,7 @@ func (hdl *DownloadHandler) handlePost(rw http.ResponseWriter, r *http.Request)
 	err = req.FromJSON(r.Body)
 	if err != nil {
 		http.Error(rw, "Invalid request", http.StatusBadRequest)
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
@@ -93,13 +179,15 @@ func (hdl *DownloadHandler) handlePost(rw http.ResponseWriter, r *http.Request)
 	for _, file := range req.Files {
 		fullFilePath, err := fsPermission.CheckRead(file)
 		if err != nil {
-			log.Errorf("%v, err: %v", *fsPermission, err)
+			logger.Errorf("%s, err: %v", fsPermission.String(), err)
+			auditDenied(fsPermission, r, audit.OP_DOWNLOAD_SIGN, file, err)
 			http.Error(rw, fmt.Sprintf("No permission to %s", file), http.StatusForbidden)
 			return
 		}
 		_, err = os.Stat(fullFilePath)
 		if err != nil {
-			log.Errorf("file %s does not exit, err: %v", fullFilePath, err)
+			logger.Errorf("file %s does not exit, err: %v", fullFilePath, err)
+			auditOperation(fsPermission, r, audit.OP_DOWNLOAD_SIGN, fullFilePath, 0, err)
 			http.Error(rw, fmt.Sprintf("File %s does not exit", file), http.StatusNotFound)
 			return
 		}
@@ -108,39 +196,122 @@ func (hdl *DownloadHandler) handlePost(rw http.ResponseWriter, r *http.Request)
 
 	// obtain download file path
 	downloadFilePath := ""
-	signType := auth.SIGN_REGULAR
 	if len(requestedFileList) == 0 {
-		log.Error("empty requested file list")
+		logger.Error("empty requested file list")
 		return
 	}
 	info, _ := os.Stat(requestedFileList[0])
+	inline := GetQueryParam("inline", r) == "true"
+	if inline && (len(requestedFileList) > 1 || info.IsDir()) {
+		logger.Errorf("inline url requested for %d files", len(requestedFileList))
+		http.Error(rw, "Inline url needs a single file", http.StatusBadRequest)
+		return
+	}
 	if len(requestedFileList) == 1 && !info.IsDir() { // serve file directly if only one file is requested and not a folder
 		downloadFilePath = requestedFileList[0]
+	} else if GetQueryParam("async", r) == "true" { // zip files in background, the signed key is returned as job result
+		remote := r.RemoteAddr
+		job, err := jobs.Default.Submit(fsPermission.Id(), "zip", func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			reporter := events.Progress.NewReporter(fsPermission.Id(), "zip", job.Id())
+			res, err := compressAndSign(ctx, fsPermission, requestedFileList, reporter, func(written int64, total int64, current string) {
+				if total > 0 {
+					job.SetProgress(int(written * 100 / total))
+				}
+			})
+			auditSigned(fsPermission, remote, requestedFileList, err)
+			return res, err
+		})
+		if err != nil {
+			logger.Errorf("failed to submit zip job, err: %v", err)
+			http.Error(rw, "Server busy", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		res := &JobResponse{job.Snapshot()}
+		res.ToJSON(rw)
+		logger.Infof("zip job %s submitted by id: %s, num files: %d, remote: %v", job.Id(), fsPermission.Id(), len(requestedFileList), r.RemoteAddr)
+		return
 	} else { // zip files first if a folder or multiple files are requested
-		downloadFilePath, err = fs.ServeMultipleFilesWithCompression(requestedFileList)
-		signType = auth.SIGN_ZIPPED
+		reporter := events.Progress.NewReporter(fsPermission.Id(), "zip", GetOperationId(r))
+		res, err := compressAndSign(r.Context(), fsPermission, requestedFileList, reporter, nil)
+		auditSigned(fsPermission, r.RemoteAddr, requestedFileList, err)
 		if err != nil {
-			routine.CleanFile(downloadFilePath)
-			log.Error(err)
+			logger.Error(err)
 			http.Error(rw, "Failed to zip files", http.StatusNotFound)
 			return
 		}
+		rw.Header().Set(OPERATION_ID_HEADER, reporter.Id())
+		res.ToJSON(rw)
+		return
 	}
 
 	// generate signing key
-	signed, nonce, err := auth.DLSigning.Generate(&auth.SignedMetadata{TokenId: fsPermission.Id(), FilePath: downloadFilePath, ExpAt: fsPermission.ExpAt(), Type: signType})
+	res, err := signDownload(fsPermission, downloadFilePath, auth.SIGN_REGULAR, inline)
+	auditSigned(fsPermission, r.RemoteAddr, requestedFileList, err)
 	if err != nil {
-		routine.CleanFile(downloadFilePath)
-		log.Errorf("failed to sign %s, err: %v", downloadFilePath, err)
+		logger.Errorf("failed to sign %s, err: %v", downloadFilePath, err)
 		http.Error(rw, "Failed to get download url", http.StatusNotFound)
 		return
 	}
-	res := &DownloadPostResponse{
+	res.ToJSON(rw)
+	webhook.Emit(&webhook.Event{Type: webhook.EVENT_DOWNLOAD_SIGNED, TokenId: fsPermission.Id(), Path: fs.PublicPath(downloadFilePath), Size: info.Size(), Remote: r.RemoteAddr})
+	logger.Infof("signed id: %s, download path: %s, num files: %d, remote: %v", fsPermission.Id(), downloadFilePath, len(requestedFileList), r.RemoteAddr)
+}
+
+func auditSigned(fsPermission *auth.FsPermission, remote string, fileList []string, err error) {
+	for _, file := range fileList {
+		audit.Log(audit.NewRecord(fsPermission.Id(), remote, audit.OP_DOWNLOAD_SIGN, fs.PublicPath(file), 0, err))
+	}
+}
+
+func signDownload(fsPermission *auth.FsPermission, downloadFilePath string, signType string, inline bool) (*DownloadPostResponse, error) {
+	expAt := fsPermission.ExpAt()
+	if inline {
+		// inline keys are not consumed, they get a short life of their own
+		inlineExpAt := time.Now().Add(time.Duration(config.InlineKeyTTLSec) * time.Second).Unix()
+		if inlineExpAt < expAt {
+			expAt = inlineExpAt
+		}
+	}
+	signed, nonce, err := auth.DLSigning.Generate(&auth.SignedMetadata{TokenId: fsPermission.Id(), FilePath: downloadFilePath, ExpAt: expAt, Type: signType, Bandwidth: fsPermission.Bandwidth(), Inline: inline})
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadPostResponse{
 		Signed: signed,
 		Nonce:  nonce,
+	}, nil
+}
+
+// zip files and sign the archive, the archive is removed on failure
+func compressAndSign(ctx context.Context, fsPermission *auth.FsPermission, fileList []string, reporter *events.Reporter, onProgress fs.ProgressFunc) (*DownloadPostResponse, error) {
+	metrics.ZipsInFlight.Inc()
+	defer metrics.ZipsInFlight.Dec()
+	var lastWritten, lastTotal int64
+	downloadFilePath, err := fs.CompressFiles(ctx, fileList, func(written int64, total int64, current string) {
+		lastWritten, lastTotal = written, total
+		reporter.Running(&events.ProgressEvent{Bytes: written, Total: total, Current: current})
+		if onProgress != nil {
+			onProgress(written, total, current)
+		}
+	})
+	if err != nil {
+		reporter.Failed(&events.ProgressEvent{Bytes: lastWritten, Total: lastTotal})
+		routine.CleanFile(downloadFilePath)
+		return nil, err
 	}
-	res.ToJSON(rw)
-	log.Infof("signed id: %s, download path: %s, num files: %d, remote: %v", fsPermission.Id(), downloadFilePath, len(requestedFileList), r.RemoteAddr)
+	res, err := signDownload(fsPermission, downloadFilePath, auth.SIGN_ZIPPED, false)
+	if err != nil {
+		reporter.Failed(&events.ProgressEvent{Bytes: lastWritten, Total: lastTotal})
+		routine.CleanFile(downloadFilePath)
+		return nil, err
+	}
+	reporter.Done(&events.ProgressEvent{Bytes: lastWritten, Total: lastTotal})
+	for _, file := range fileList {
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_DOWNLOAD_SIGNED, TokenId: fsPermission.Id(), Path: fs.PublicPath(file)})
+	}
+	log.Infof("signed id: %s, download path: %s, num files: %d", fsPermission.Id(), downloadFilePath, len(fileList))
+	return res, nil
 }
 
 type DownloadPostRequest struct {
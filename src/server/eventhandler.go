@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/events"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+// comment line sent periodically so that proxies keep the stream open
+const sseHeartbeatInterval = 15 * time.Second
+
+type EventHandler struct {
+}
+
+func NewEventHandler() *EventHandler {
+	return &EventHandler{}
+}
+
+func (hdl *EventHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Stream progress events of uploads and zips created by the same token as Server-Sent Events
+
+GET /api/nas/v0/events?token={optional jwt token if Authorization header cannot be set}
+*/
+func (hdl *EventHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorizationForStream(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	stream, err := NewSSEWriter(rw)
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	eventChan, unsubscribe := events.Progress.Subscribe(fsPermission.Id())
+	defer unsubscribe()
+	logger.Infof("progress stream opened, id: %s, remote: %s", fsPermission.Id(), r.RemoteAddr)
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-eventChan:
+			err = stream.Send("progress", e)
+		case <-heartbeat.C:
+			err = stream.Heartbeat()
+		case <-r.Context().Done():
+			logger.Infof("progress stream closed, id: %s, remote: %s", fsPermission.Id(), r.RemoteAddr)
+			return
+		}
+		if err != nil {
+			logger.Errorf("failed to write progress stream, id: %s, err: %v", fsPermission.Id(), err)
+			return
+		}
+	}
+}
+
+type SSEWriter struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+}
+
+// Write Server-Sent Events headers and return a writer for events.
+func NewSSEWriter(rw http.ResponseWriter) (*SSEWriter, error) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer does not support flushing")
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &SSEWriter{rw: rw, flusher: flusher}, nil
+}
+
+func (w *SSEWriter) Send(event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.rw, "event: %s\ndata: %s\n\n", event, b)
+	if err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
+
+func (w *SSEWriter) Heartbeat() error {
+	_, err := fmt.Fprint(w.rw, ": ping\n\n")
+	if err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/lyokalita/naspublic.ftserver/src/health"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+type HealthHandler struct {
+	readiness bool
+}
+
+func NewHealthHandler(readiness bool) *HealthHandler {
+	return &HealthHandler{
+		readiness: readiness,
+	}
+}
+
+/*
+Liveness and readiness probes, 503 is returned if any check fails
+
+GET /healthz
+GET /readyz
+*/
+func (hdl *HealthHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	res := &HealthResponse{Status: "ok"}
+	ok := health.IsListening()
+	if hdl.readiness {
+		res.Checks, ok = health.Readiness()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if !ok {
+		res.Status = "unavailable"
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		middleware.RequestLog(r).Errorf("health check failed, readiness: %v, remote: %s", hdl.readiness, r.RemoteAddr)
+	}
+	res.ToJSON(rw)
+}
+
+type HealthResponse struct {
+	Status string                `json:"status"`
+	Checks []*health.CheckResult `json:"checks,omitempty"`
+}
+
+func (p *HealthResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
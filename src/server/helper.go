@@ -1,11 +1,20 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
 	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/ratelimit"
+	"github.com/lyokalita/naspublic.ftserver/src/search"
+	"github.com/lyokalita/naspublic.ftserver/src/thumb"
 	"github.com/lyokalita/naspublic.ftserver/src/utils"
 )
 
@@ -26,6 +35,7 @@ func ValidateJwtAuthorization(rw http.ResponseWriter, r *http.Request) (*auth.Fs
 	authHeader := r.Header.Get("Authorization")
 	token, err := GetTokenFromHeader(authHeader)
 	if err != nil {
+		metrics.TokenValidationFailures.WithLabelValues("missing").Inc()
 		http.Error(rw, "Invalid token", http.StatusUnauthorized)
 		return nil, err
 	}
@@ -33,6 +43,7 @@ func ValidateJwtAuthorization(rw http.ResponseWriter, r *http.Request) (*auth.Fs
 	// check token is valid and not expired
 	fsPermission, err := auth.ValidateJwtToken(token)
 	if err != nil {
+		metrics.TokenValidationFailures.WithLabelValues(auth.ValidationFailureReason(err)).Inc()
 		if strings.Contains(err.Error(), "expired") {
 			http.Error(rw, "Token expired", http.StatusUnauthorized)
 		} else {
@@ -43,6 +54,77 @@ func ValidateJwtAuthorization(rw http.ResponseWriter, r *http.Request) (*auth.Fs
 	return fsPermission, nil
 }
 
+// Clients are locked out after repeated failures of admin secret or signed keys
+var authLockout *ratelimit.Lockout = ratelimit.NewLockout(0, 0, 0)
+
+// Check the request carries the admin secret
+func ValidateAdminAuthorization(rw http.ResponseWriter, r *http.Request) error {
+	err := CheckLockout(rw, r)
+	if err != nil {
+		return err
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	token, err := GetTokenFromHeader(authHeader)
+	if err != nil {
+		RecordAuthFailure(r)
+		http.Error(rw, "Invalid token", http.StatusUnauthorized)
+		return err
+	}
+	if !SecureCompare(token, config.AuthSecret) {
+		RecordAuthFailure(r)
+		http.Error(rw, "Invalid token", http.StatusUnauthorized)
+		return fmt.Errorf("token not correct")
+	}
+	authLockout.Success(ratelimit.ClientIp(r))
+	return nil
+}
+
+// Reply 429 if the client is locked out.
+func CheckLockout(rw http.ResponseWriter, r *http.Request) error {
+	ip := ratelimit.ClientIp(r)
+	if wait := authLockout.Locked(ip); wait > 0 {
+		ratelimit.TooManyRequests(rw, wait)
+		return fmt.Errorf("%s is locked out for %v", ip, wait)
+	}
+	return nil
+}
+
+func RecordAuthFailure(r *http.Request) {
+	err := authLockout.Failure(ratelimit.ClientIp(r))
+	if err != nil {
+		middleware.RequestLog(r).Error(err)
+	}
+}
+
+// Compare secrets in constant time.
+func SecureCompare(given string, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// Same as ValidateJwtAuthorization, but also accepts the token from query parameter "token"
+// since EventSource in browsers cannot set headers.
+func ValidateJwtAuthorizationForStream(rw http.ResponseWriter, r *http.Request) (*auth.FsPermission, error) {
+	if r.Header.Get("Authorization") == "" {
+		token := GetQueryParam("token", r)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return ValidateJwtAuthorization(rw, r)
+}
+
+const OPERATION_ID_HEADER = "X-Operation-Id"
+
+// Get operation id chosen by the client to correlate progress events, or a random one.
+func GetOperationId(r *http.Request) string {
+	op := GetQueryParam("op", r)
+	if op == "" || len(op) > 64 {
+		return string(utils.GetRandomBytes(16))
+	}
+	return op
+}
+
 func GetQueryParam(param string, r *http.Request) string {
 	keys, ok := r.URL.Query()[param]
 	key := ""
@@ -51,3 +133,99 @@ func GetQueryParam(param string, r *http.Request) string {
 	}
 	return key
 }
+
+// Write an audit record for an operation on fullPath, err is nil on success.
+func auditOperation(fsPermission *auth.FsPermission, r *http.Request, operation string, fullPath string, bytes int64, err error) {
+	originOf(r).auditOperation(fsPermission, operation, fullPath, bytes, err)
+}
+
+// Same as auditOperation, for operations not authorized by a token such as share links.
+func auditOperationById(tokenId string, r *http.Request, operation string, fullPath string, bytes int64, err error) {
+	logAuditRecord(r, audit.NewRecord(tokenId, r.RemoteAddr, operation, fs.PublicPath(fullPath), bytes, err))
+}
+
+// Write an audit record for an operation rejected by permission check, queryPath is relative to the token directory.
+func auditDenied(fsPermission *auth.FsPermission, r *http.Request, operation string, queryPath string, err error) {
+	rec := audit.NewRecord(fsPermission.Id(), r.RemoteAddr, operation, fs.PublicPath(fsPermission.FullPath(queryPath)), 0, err)
+	rec.Outcome = audit.OUTCOME_DENIED
+	logAuditRecord(r, rec)
+}
+
+// Refresh search indexes and thumbnails of fullPath after it is created or modified, the work is done in background.
+func pathChanged(fullPath string) {
+	if search.Default != nil {
+		search.Default.Put(fullPath)
+	}
+	if search.Content != nil {
+		search.Content.Enqueue(fullPath)
+	}
+	if thumb.Default != nil {
+		thumb.Default.Invalidate(fullPath)
+		if config.ThumbOnUpload {
+			thumb.Default.Prepare(fullPath)
+		}
+	}
+}
+
+// Same as pathChanged for fullPath and everything under it, used when a folder is moved or copied.
+func treeChanged(fullPath string) {
+	if search.Default != nil {
+		search.Default.PutTree(fullPath)
+	}
+	if search.Content != nil {
+		search.Content.EnqueueTree(fullPath)
+	}
+	if thumb.Default != nil {
+		thumb.Default.Invalidate(fullPath)
+	}
+}
+
+// Drop fullPath and everything under it from search indexes and thumbnails.
+func pathRemoved(fullPath string) {
+	if search.Default != nil {
+		search.Default.Remove(fullPath)
+	}
+	if search.Content != nil {
+		search.Content.Remove(fullPath)
+	}
+	if thumb.Default != nil {
+		thumb.Default.Invalidate(fullPath)
+	}
+}
+
+// Write an audit record tagged with the request id.
+func logAuditRecord(r *http.Request, rec *audit.Record) {
+	originOf(r).audit(rec)
+}
+
+/*
+Id and remote address of a request, copied for jobs that run after the request is served
+so that they do not keep the request itself.
+*/
+type requestOrigin struct {
+	requestId string
+	remote    string
+}
+
+func originOf(r *http.Request) *requestOrigin {
+	return &requestOrigin{requestId: middleware.GetRequestId(r), remote: r.RemoteAddr}
+}
+
+func (o *requestOrigin) logger() *middleware.RequestLogger {
+	return middleware.RequestLogById(o.requestId)
+}
+
+// Write an audit record tagged with the request id.
+func (o *requestOrigin) audit(rec *audit.Record) {
+	rec.RequestId = o.requestId
+	audit.Log(rec)
+}
+
+// Same as auditOperation, for jobs.
+func (o *requestOrigin) auditOperation(fsPermission *auth.FsPermission, operation string, fullPath string, bytes int64, err error) {
+	tokenId := ""
+	if fsPermission != nil {
+		tokenId = fsPermission.Id()
+	}
+	o.audit(audit.NewRecord(tokenId, o.remote, operation, fs.PublicPath(fullPath), bytes, err))
+}
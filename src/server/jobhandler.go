@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+type JobHandler struct {
+	prefix string
+}
+
+func NewJobHandler() *JobHandler {
+	return &JobHandler{
+		prefix: path.Join(config.ApiPath, "jobs") + "/",
+	}
+}
+
+func (hdl *JobHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		hdl.handleDelete(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Get state of a job created by the same token
+
+GET /api/nas/v0/jobs/{job id}
+*/
+func (hdl *JobHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	job, err := jobs.Default.Get(fsPermission.Id(), hdl.getJobId(r))
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	res := &JobResponse{job.Snapshot()}
+	res.ToJSON(rw)
+}
+
+/*
+Cancel a job created by the same token, a running job is reported cancelled once its work stops
+
+DELETE /api/nas/v0/jobs/{job id}
+*/
+func (hdl *JobHandler) handleDelete(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	job, err := jobs.Default.Cancel(fsPermission.Id(), hdl.getJobId(r))
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	res := &JobResponse{job.Snapshot()}
+	res.ToJSON(rw)
+	logger.Infof("job %s cancelled by id: %s, remote: %s", job.Id(), fsPermission.Id(), r.RemoteAddr)
+}
+
+func (hdl *JobHandler) getJobId(r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.URL.Path, hdl.prefix), "/")
+}
+
+type JobResponse struct {
+	*jobs.Snapshot
+}
+
+func (p *JobResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
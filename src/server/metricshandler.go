@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+type MetricsHandler struct {
+	next http.Handler
+}
+
+func NewMetricsHandler() *MetricsHandler {
+	metrics.RegisterGaugeFunc("signed_keys_outstanding", "Number of signed download keys not used yet.", func() float64 {
+		return float64(auth.DLSigning.Len())
+	})
+	metrics.RegisterGaugeFunc("jobs_pending", "Number of queued and running background jobs.", func() float64 {
+		if jobs.Default == nil {
+			return 0
+		}
+		return float64(jobs.Default.Pending())
+	})
+	metrics.RegisterDirectorySize("temp_directory_bytes", "Total size of files in the temp directory.", config.TempDirectoryRoot, time.Minute)
+	return &MetricsHandler{
+		next: metrics.Handler(),
+	}
+}
+
+/*
+Expose metrics in Prometheus format, requires bearer NASPUBLIC_METRICS_TOKEN
+
+GET /metrics
+*/
+func (hdl *MetricsHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := GetTokenFromHeader(r.Header.Get("Authorization"))
+	if err != nil || config.MetricsToken == "" || !SecureCompare(token, config.MetricsToken) {
+		middleware.RequestLog(r).Errorf("invalid metrics token, remote: %s", r.RemoteAddr)
+		http.Error(rw, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	hdl.next.ServeHTTP(rw, r)
+}
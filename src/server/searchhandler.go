@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/search"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+type SearchHandler struct {
+}
+
+func NewSearchHandler() *SearchHandler {
+	return &SearchHandler{}
+}
+
+func (hdl *SearchHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if search.Default == nil {
+		middleware.RequestLog(r).Error("search index is not loaded")
+		http.Error(rw, "Search unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Search files and folders under a directory by name. Names match q as a glob if it has *, ? or [, otherwise as a substring.
+Sizes are in bytes and times in RFC3339.
+
+GET /api/nas/v0/search?key={directory path}&q={name}&type={file or folder}&minSize={size}&maxSize={size}&from={modified after}&to={modified before}&limit={max results}
+*/
+func (hdl *SearchHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	queryDir := GetQueryParam("key", r)
+	queryDir = path.Join(queryDir)
+
+	// check permission and get full directory
+	fullQueryPath, err := fsPermission.CheckRead(queryDir)
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_SEARCH, queryDir, err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	query, err := parseSearchQuery(r)
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	query.Root = fullQueryPath
+
+	entries, truncated := search.Default.Search(query)
+	res := &SearchResponse{
+		QueryFolder: queryDir,
+		Results:     []*SearchResult{},
+		Truncated:   truncated,
+	}
+	for _, entry := range entries {
+		res.Results = append(res.Results, newSearchResult(queryDir, fullQueryPath, entry))
+	}
+	res.ToJSON(rw)
+	auditOperation(fsPermission, r, audit.OP_SEARCH, fullQueryPath, 0, nil)
+	logger.Infof("search full path: %s, query: %+v, num results: %d, remote: %s", fullQueryPath, *query, len(res.Results), r.RemoteAddr)
+}
+
+func parseSearchQuery(r *http.Request) (*search.Query, error) {
+	query := &search.Query{
+		Name:  GetQueryParam("q", r),
+		Type:  GetQueryParam("type", r),
+		Limit: config.SearchMaxResults,
+	}
+	if query.Type != "" && query.Type != "file" && query.Type != "folder" {
+		return nil, fmt.Errorf("invalid type %s", query.Type)
+	}
+	if query.Name != "" {
+		_, err := path.Match(query.Name, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if value := GetQueryParam("minSize", r); value != "" {
+		query.MinSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || query.MinSize < 0 {
+			return nil, fmt.Errorf("invalid min size %s", value)
+		}
+	}
+	if value := GetQueryParam("maxSize", r); value != "" {
+		query.MaxSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || query.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid max size %s", value)
+		}
+	}
+	if value := GetQueryParam("from", r); value != "" {
+		query.From, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value := GetQueryParam("to", r); value != "" {
+		query.To, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value := GetQueryParam("limit", r); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit %s", value)
+		}
+		if limit < query.Limit {
+			query.Limit = limit
+		}
+	}
+	return query, nil
+}
+
+type SearchResult struct {
+	Path string `json:"path"`
+	fs.FileMetadata
+}
+
+// path of the result is relative to the token directory like the key of other requests
+func newSearchResult(queryDir string, fullQueryPath string, entry *search.Entry) *SearchResult {
+	rel, _ := filepath.Rel(fullQueryPath, entry.Path)
+	fileType := fs.TYPE_FOLDER
+	if !entry.IsDir {
+		fileType = utils.GetFileExtension(entry.Name)
+	}
+	return &SearchResult{
+		Path: path.Join("/", queryDir, filepath.ToSlash(rel)),
+		FileMetadata: fs.FileMetadata{
+			Name:         entry.Name,
+			Type:         fileType,
+			Size:         entry.Size,
+			LastModified: utils.ConvertUnixTimeToString(entry.ModTime),
+		},
+	}
+}
+
+type SearchResponse struct {
+	QueryFolder string          `json:"queryFolder"`
+	Results     []*SearchResult `json:"results"`
+	Truncated   bool            `json:"truncated"`
+}
+
+func (p *SearchResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
+
+type ContentSearchHandler struct {
+}
+
+func NewContentSearchHandler() *ContentSearchHandler {
+	return &ContentSearchHandler{}
+}
+
+func (hdl *ContentSearchHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if search.Content == nil {
+		middleware.RequestLog(r).Error("content index is not loaded")
+		http.Error(rw, "Content search unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Search text files under a directory by words, best matches first.
+Results come by pages of at most content_page_max files, total is the number of matching files.
+
+GET /api/nas/v0/search/content?key={directory path}&q={words}&offset={optional first result}&limit={optional page size}
+*/
+func (hdl *ContentSearchHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	queryDir := GetQueryParam("key", r)
+	queryDir = path.Join(queryDir)
+
+	// check permission and get full directory
+	fullQueryPath, err := fsPermission.CheckRead(queryDir)
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_SEARCH, queryDir, err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	q := GetQueryParam("q", r)
+	if q == "" {
+		http.Error(rw, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	limit := config.SearchContentPageMax
+	if value := GetQueryParam("limit", r); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(rw, "Invalid query", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	offset := 0
+	if value := GetQueryParam("offset", r); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			http.Error(rw, "Invalid query", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, total := search.Content.Search(fullQueryPath, q, offset, limit)
+	res := &ContentSearchResponse{
+		QueryFolder: queryDir,
+		Offset:      offset,
+		Total:       total,
+		Results:     []*search.ContentResult{},
+	}
+	for _, result := range results {
+		rel, _ := filepath.Rel(fullQueryPath, result.Path)
+		result.Path = path.Join("/", queryDir, filepath.ToSlash(rel))
+		res.Results = append(res.Results, result)
+	}
+	res.ToJSON(rw)
+	auditOperation(fsPermission, r, audit.OP_SEARCH, fullQueryPath, 0, nil)
+	logger.Infof("content search full path: %s, num results: %d, remote: %s", fullQueryPath, len(res.Results), r.RemoteAddr)
+}
+
+type ContentSearchResponse struct {
+	QueryFolder string                  `json:"queryFolder"`
+	Offset      int                     `json:"offset"`
+	Total       int                     `json:"total"`
+	Results     []*search.ContentResult `json:"results"`
+}
+
+func (p *ContentSearchResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
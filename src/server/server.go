@@ -2,38 +2,76 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"path"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/health"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/ratelimit"
 	"github.com/rs/cors"
 )
 
 var server *http.Server
+var accessLogger log.LoggerInterface
 
-func StartHttpServer() {
+// Receives the error if the server stops serving unexpectedly
+var ServerErrors = make(chan error, 1)
+
+/*
+Bind the listener and serve in background
+
+return:
+- error if the certificate cannot be loaded or the address cannot be bound
+*/
+func StartHttpServer() error {
 	sm := constructServerMux()
 	addr := getServerAddr()
 
+	// load certificate up front so that a bad certificate fails the start
+	cert, err := tls.LoadX509KeyPair(config.SSLCertPath, config.SSLKeyPath)
+	if err != nil {
+		return err
+	}
+
+	accessLogger, err = newAccessLogger()
+	if err != nil {
+		return err
+	}
+
 	server = &http.Server{
-		Addr:    addr,
-		Handler: sm,
+		Addr:      addr,
+		Handler:   middleware.Chain(sm, middleware.RequestId, middleware.AccessLog(accessLogger), middleware.Recover),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
 		// IdleTimeout:  time.Duration(120) * time.Second,
 		// ReadTimeout:  5 * time.Second,
 		// WriteTimeout: 5 * time.Second,
 	}
 
-	// wrapping ListenAndServe in gofunc so it's not going to block
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	health.SetListening(true)
+
+	// wrapping Serve in gofunc so it's not going to block
 	go func() {
-		err := server.ListenAndServeTLS(config.SSLCertPath, config.SSLKeyPath)
-		if err != nil {
+		err := server.ServeTLS(listener, "", "")
+		health.SetListening(false)
+		if err != nil && err != http.ErrServerClosed {
 			log.Error(err)
+			ServerErrors <- err
 		}
 	}()
 
 	log.Infof("nas file transfer server listens at %s", path.Join(addr, config.ApiPath))
+	return nil
 }
 
 func StopHttpServer(ctx context.Context) {
@@ -41,16 +79,18 @@ func StopHttpServer(ctx context.Context) {
 	if err != nil {
 		log.Info(err)
 	}
+	accessLogger.Flush()
 }
 
 func constructServerMux() *http.ServeMux {
+	authLockout = ratelimit.NewLockout(config.LockoutMaxFailures, time.Duration(config.LockoutWindowSec)*time.Second, time.Duration(config.LockoutDurationSec)*time.Second)
+
 	// /upload
 	uploadCors := cors.New(cors.Options{
 		AllowedOrigins: config.WebfrontendOrigin,
 		AllowedMethods: []string{http.MethodPost},
-		AllowedHeaders: []string{"Authorization"},
+		AllowedHeaders: []string{"Authorization", SHARE_PASSWORD_HEADER},
 	})
-	uploadHandler := uploadCors.Handler(NewUploadHandler())
 
 	// /download
 	downloadCors := cors.New(cors.Options{
@@ -58,7 +98,6 @@ func constructServerMux() *http.ServeMux {
 		AllowedMethods: []string{http.MethodGet, http.MethodPost},
 		AllowedHeaders: []string{"Authorization"},
 	})
-	downloadHandler := downloadCors.Handler(NewDownloadHandler())
 
 	// /dir
 	dirCors := cors.New(cors.Options{
@@ -66,7 +105,13 @@ func constructServerMux() *http.ServeMux {
 		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
 		AllowedHeaders: []string{"Authorization"},
 	})
-	listHandler := dirCors.Handler(NewDirHandler())
+
+	// /dir/watch
+	dirWatchCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"Authorization"},
+	})
 
 	// /auth
 	authCors := cors.New(cors.Options{
@@ -74,17 +119,112 @@ func constructServerMux() *http.ServeMux {
 		AllowedMethods: []string{http.MethodPost, http.MethodGet},
 		AllowedHeaders: []string{"Authorization"},
 	})
-	AuthHandler := authCors.Handler(NewAuthHandler())
+
+	// /share
+	shareCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /s/{id}, opened by outsiders from any origin
+	shareLinkCors := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{SHARE_PASSWORD_HEADER},
+	})
+
+	// /audit
+	auditCors := cors.New(cors.Options{
+		AllowedOrigins: config.AuthOrigin,
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /jobs/{id}
+	jobCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /events
+	eventCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /search
+	searchCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /thumb
+	thumbCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"Authorization"},
+	})
+
+	// /stat
+	statCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodGet, http.MethodHead},
+		AllowedHeaders: []string{"Authorization", "If-None-Match"},
+		ExposedHeaders: []string{"ETag"},
+	})
+
+	// /batch
+	batchCors := cors.New(cors.Options{
+		AllowedOrigins: config.WebfrontendOrigin,
+		AllowedMethods: []string{http.MethodPost},
+		AllowedHeaders: []string{"Authorization"},
+	})
 
 	sm := http.NewServeMux()
-	sm.Handle(path.Join(config.ApiPath, "upload"), uploadHandler)
-	sm.Handle(path.Join(config.ApiPath, "download"), downloadHandler)
-	sm.Handle(path.Join(config.ApiPath, "dir"), listHandler)
-	sm.Handle(path.Join(config.ApiPath, "auth"), AuthHandler)
+	sm.Handle(path.Join(config.ApiPath, "upload"), routeHandler("upload", uploadCors, NewUploadHandler()))
+	sm.Handle(path.Join(config.ApiPath, "download"), routeHandler("download", downloadCors, NewDownloadHandler()))
+	sm.Handle(path.Join(config.ApiPath, "dir"), routeHandler("dir", dirCors, NewDirHandler()))
+	sm.Handle(path.Join(config.ApiPath, "dir", "watch"), routeHandler("dir_watch", dirWatchCors, NewDirWatchHandler()))
+	sm.Handle(path.Join(config.ApiPath, "auth"), routeHandler("auth", authCors, NewAuthHandler()))
+	sm.Handle(path.Join(config.ApiPath, "audit"), routeHandler("audit", auditCors, NewAuditHandler()))
+	sm.Handle(path.Join(config.ApiPath, "jobs")+"/", routeHandler("jobs", jobCors, NewJobHandler()))
+	sm.Handle(path.Join(config.ApiPath, "events"), routeHandler("events", eventCors, NewEventHandler()))
+	sm.Handle(path.Join(config.ApiPath, "share"), routeHandler("share", shareCors, NewShareHandler()))
+	sm.Handle(path.Join(config.ApiPath, "s")+"/", routeHandler("share_link", shareLinkCors, NewShareLinkHandler()))
+	sm.Handle(path.Join(config.ApiPath, "search"), routeHandler("search", searchCors, NewSearchHandler()))
+	sm.Handle(path.Join(config.ApiPath, "search", "content"), routeHandler("search", searchCors, NewContentSearchHandler()))
+	sm.Handle(path.Join(config.ApiPath, "thumb"), routeHandler("thumb", thumbCors, NewThumbHandler()))
+	sm.Handle(path.Join(config.ApiPath, "stat"), routeHandler("stat", statCors, NewStatHandler()))
+	sm.Handle(path.Join(config.ApiPath, "batch"), routeHandler("batch", batchCors, NewBatchHandler()))
+	sm.Handle("/healthz", NewHealthHandler(false))
+	sm.Handle("/readyz", NewHealthHandler(true))
+	if config.MetricsEnabled {
+		sm.Handle("/metrics", NewMetricsHandler())
+	}
 
 	return sm
 }
 
+/*
+Wrap handler of a route with metrics, CORS and the configured rate limit.
+The limit is applied inside CORS so that rejected requests carry CORS headers and preflights are not counted.
+*/
+func routeHandler(route string, routeCors *cors.Cors, handler http.Handler) http.Handler {
+	if limit, ok := config.RateLimits[route]; ok {
+		handler = ratelimit.NewRouteLimiter(route, limit.IpRate, limit.IpBurst, limit.TokenRate, limit.TokenBurst).Handler(handler)
+	}
+	return metrics.Instrument(route, routeCors.Handler(handler))
+}
+
+// access log is written to its own file without the application log prefix
+func newAccessLogger() (log.LoggerInterface, error) {
+	return log.LoggerFromConfigAsString(fmt.Sprintf(`<seelog minlevel="info"><outputs formatid="access"><buffered size="10000" flushperiod="1000"><rollingfile type="size" filename="%s" maxsize="100000000" maxrolls="20"/></buffered></outputs><formats><format id="access" format="%%Msg%%n"/></formats></seelog>`, config.AccessLogPath))
+}
+
 func getServerAddr() string {
 	return fmt.Sprintf("%s:%d", config.ServerHost, config.ServerPort)
 }
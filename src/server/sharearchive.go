@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+// an archive replaced by a newer one is kept this long so that keys signed for it can still be used
+const shareArchiveGrace = 10 * time.Minute
+
+/*
+Zipped folders of shares, an archive is built once in background and served to every redeem
+until the folder changes, so that outsiders cannot make the server zip a folder on each request.
+*/
+type shareArchives struct {
+	mu       sync.Mutex
+	archives map[string]*shareArchive // by share id
+}
+
+type shareArchive struct {
+	fingerprint string
+	zipPath     string
+	err         error
+	ready       chan struct{}
+}
+
+var sharedFolders = &shareArchives{archives: map[string]*shareArchive{}}
+
+/*
+Get the archive of a shared folder, built if the folder changed since the last one.
+Waits for the build until ctx is done, the build goes on for the next requests.
+
+return:
+- path of the zip file, it must not be removed by the caller
+*/
+func (c *shareArchives) Get(ctx context.Context, sh *share.Share) (string, error) {
+	fingerprint, err := folderFingerprint(sh.FilePath)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.pruneLocked()
+	a, ok := c.archives[sh.Id]
+	if !ok || a.fingerprint != fingerprint {
+		if ok {
+			c.retire(a)
+		}
+		a = &shareArchive{fingerprint: fingerprint, ready: make(chan struct{})}
+		c.archives[sh.Id] = a
+		go c.build(sh, a)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-a.ready:
+		return a.zipPath, a.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Drop the archive of a deleted share.
+func (c *shareArchives) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.archives[id]
+	if ok {
+		delete(c.archives, id)
+		c.retire(a)
+	}
+}
+
+func (c *shareArchives) build(sh *share.Share, a *shareArchive) {
+	defer close(a.ready)
+	dir := path.Join(config.TempDirectoryRoot, fmt.Sprintf("share_%s_%s", sh.Id, string(utils.GetRandomBytes(8))))
+	err := os.Mkdir(dir, os.ModePerm)
+	if err != nil {
+		a.err = err
+	} else {
+		var zipPath string
+		zipPath, a.err = fs.CompressFiles(context.Background(), []string{sh.FilePath}, nil)
+		a.zipPath = path.Join(dir, path.Base(sh.FilePath)+".zip")
+		if a.err == nil {
+			a.err = os.Rename(zipPath, a.zipPath)
+		}
+		if a.err != nil {
+			os.Remove(zipPath)
+		}
+	}
+	if a.err != nil {
+		log.Errorf("failed to zip share %s, err: %v", sh.Id, a.err)
+		// let the next request try again
+		c.mu.Lock()
+		if c.archives[sh.Id] == a {
+			delete(c.archives, sh.Id)
+		}
+		c.mu.Unlock()
+		os.RemoveAll(dir)
+		return
+	}
+	log.Infof("share %s zipped to %s", sh.Id, a.zipPath)
+}
+
+// remove the archive once it is built and the keys signed for it had time to be used
+func (c *shareArchives) retire(a *shareArchive) {
+	go func() {
+		<-a.ready
+		if a.err != nil {
+			return
+		}
+		time.AfterFunc(shareArchiveGrace, func() {
+			os.RemoveAll(path.Dir(a.zipPath))
+		})
+	}()
+}
+
+// drop archives of deleted and expired shares
+func (c *shareArchives) pruneLocked() {
+	for id, a := range c.archives {
+		if share.Default == nil || !share.Default.Exists(id) {
+			delete(c.archives, id)
+			c.retire(a)
+		}
+	}
+}
+
+// count, total size and latest modification of everything under dirPath, any change gives another fingerprint
+func folderFingerprint(dirPath string) (string, error) {
+	var count, total, latest int64
+	err := filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		count++
+		total += info.Size()
+		if mtime := info.ModTime().UnixNano(); mtime > latest {
+			latest = mtime
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d|%d|%d", count, total, latest), nil
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+// bcrypt ignores bytes after 72
+const maxSharePasswordLength = 72
+
+type ShareHandler struct {
+}
+
+func NewShareHandler() *ShareHandler {
+	return &ShareHandler{}
+}
+
+func (hdl *ShareHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if share.Default == nil {
+		middleware.RequestLog(r).Error("share store is not loaded")
+		http.Error(rw, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	if r.Method == http.MethodPost {
+		hdl.handlePost(rw, r)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		hdl.handleDelete(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Create a share link to a file or folder readable by the token,
+or a dropbox link to a folder writable by the token
+
+POST /api/nas/v0/share
+*/
+func (hdl *ShareHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	req := &SharePostRequest{}
+	err = req.FromJSON(r.Body)
+	if err != nil {
+		http.Error(rw, "Invalid request", http.StatusBadRequest)
+		logger.Error(err)
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		logger.Error(err)
+		return
+	}
+
+	// check permission and get full path, dropbox links write into the folder
+	queryPath := path.Join(req.Path)
+	var fullQueryPath string
+	if req.Type == share.SHARE_DROPBOX {
+		fullQueryPath, err = fsPermission.CheckWrite(queryPath)
+	} else {
+		fullQueryPath, err = fsPermission.CheckRead(queryPath)
+	}
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_SHARE_CREATE, queryPath, err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	// check path exists
+	info, err := os.Stat(fullQueryPath)
+	if err != nil {
+		logger.Errorf("path %s does not exit, err: %v", fullQueryPath, err)
+		http.Error(rw, "Target not exist", http.StatusNotFound)
+		return
+	}
+	if req.Type == share.SHARE_DROPBOX && !info.IsDir() {
+		logger.Errorf("dropbox target %s is not a folder", fullQueryPath)
+		http.Error(rw, "Dropbox target must be a folder", http.StatusBadRequest)
+		return
+	}
+
+	// a share never outlives the token creating it
+	expAt := time.Now().Add(time.Minute * time.Duration(req.Valid)).Unix()
+	if expAt > fsPermission.ExpAt() {
+		expAt = fsPermission.ExpAt()
+	}
+
+	sh, err := share.Default.Create(fsPermission.Id(), fullQueryPath, &share.Options{
+		Type:         req.Type,
+		Password:     req.Password,
+		ExpAt:        expAt,
+		MaxDownloads: req.MaxDownloads,
+		AllowedIps:   req.AllowedIps,
+		Bandwidth:    fsPermission.Bandwidth(),
+		MaxFileSize:  req.MaxFileSize,
+		Quota:        req.Quota,
+	})
+	auditOperation(fsPermission, r, audit.OP_SHARE_CREATE, fullQueryPath, 0, err)
+	if err != nil {
+		logger.Errorf("failed to create share for %s, err: %v", fullQueryPath, err)
+		http.Error(rw, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+
+	res := newShareResponse(sh)
+	res.ToJSON(rw)
+	logger.Infof("share %s created by id: %s, path: %s, remote: %s", sh.Id, fsPermission.Id(), fullQueryPath, r.RemoteAddr)
+}
+
+/*
+List share links created by the token
+
+GET /api/nas/v0/share
+*/
+func (hdl *ShareHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		middleware.RequestLog(r).Error(err)
+		return
+	}
+
+	res := &ShareListResponse{Shares: []*ShareResponse{}}
+	for _, sh := range share.Default.List(fsPermission.Id()) {
+		res.Shares = append(res.Shares, newShareResponse(sh))
+	}
+	res.ToJSON(rw)
+}
+
+/*
+Delete a share link created by the token
+
+DELETE /api/nas/v0/share?id={share id}
+*/
+func (hdl *ShareHandler) handleDelete(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	id := GetQueryParam("id", r)
+	err = share.Default.Delete(fsPermission.Id(), id)
+	if err != nil {
+		logger.Errorf("failed to delete share %s, err: %v", id, err)
+		http.Error(rw, "Share not found", http.StatusNotFound)
+		return
+	}
+	sharedFolders.Remove(id)
+	logAuditRecord(r, &audit.Record{TokenId: fsPermission.Id(), Remote: r.RemoteAddr, Operation: audit.OP_SHARE_DELETE, Path: id, Outcome: audit.OUTCOME_SUCCESS})
+	rw.Write([]byte(id))
+	logger.Infof("share %s deleted by id: %s, remote: %s", id, fsPermission.Id(), r.RemoteAddr)
+}
+
+type SharePostRequest struct {
+	Type         string   `json:"type"`
+	Path         string   `json:"path"`
+	Password     string   `json:"password"`
+	Valid        int64    `json:"valid"`
+	MaxDownloads int      `json:"maxDownloads"`
+	AllowedIps   []string `json:"allowedIps"`
+	MaxFileSize  int64    `json:"maxFileSize"`
+	Quota        int64    `json:"quota"`
+}
+
+func (p *SharePostRequest) FromJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	return decoder.Decode(p)
+}
+
+func (p *SharePostRequest) Validate() error {
+	if p.Type == "" {
+		p.Type = share.SHARE_DOWNLOAD
+	}
+	if p.Type != share.SHARE_DOWNLOAD && p.Type != share.SHARE_DROPBOX {
+		return fmt.Errorf("invalid share type %s", p.Type)
+	}
+	if p.Valid <= 0 {
+		return fmt.Errorf("invalid expiration period")
+	}
+	if p.MaxFileSize < 0 || p.Quota < 0 {
+		return fmt.Errorf("invalid size limit")
+	}
+	if p.MaxDownloads < 0 {
+		return fmt.Errorf("invalid max downloads")
+	}
+	if len(p.Password) > maxSharePasswordLength {
+		return fmt.Errorf("password too long")
+	}
+	for _, ip := range p.AllowedIps {
+		if !share.IsValidIpRule(ip) {
+			return fmt.Errorf("invalid allowed ip %s", ip)
+		}
+	}
+	return nil
+}
+
+type ShareResponse struct {
+	Id           string   `json:"id"`
+	Type         string   `json:"type"`
+	Url          string   `json:"url"`
+	ExpAt        string   `json:"expAt"`
+	HasPassword  bool     `json:"hasPassword"`
+	MaxDownloads int      `json:"maxDownloads"`
+	Downloads    int      `json:"downloads"`
+	AllowedIps   []string `json:"allowedIps,omitempty"`
+	MaxFileSize  int64    `json:"maxFileSize,omitempty"`
+	Quota        int64    `json:"quota,omitempty"`
+	UsedBytes    int64    `json:"usedBytes,omitempty"`
+}
+
+func newShareResponse(sh *share.Share) *ShareResponse {
+	url := config.ShareBaseUrl + path.Join(config.ApiPath, "s", sh.Id)
+	if sh.Type == share.SHARE_DROPBOX {
+		url = config.ShareBaseUrl + path.Join(config.ApiPath, "upload") + "?dropbox=" + sh.Id
+	}
+	return &ShareResponse{
+		Id:           sh.Id,
+		Type:         sh.Type,
+		Url:          url,
+		ExpAt:        utils.ConvertUnixTimeToString(sh.ExpAt),
+		HasPassword:  sh.HasPassword(),
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		AllowedIps:   sh.AllowedIps,
+		MaxFileSize:  sh.MaxFileSize,
+		Quota:        sh.Quota,
+		UsedBytes:    sh.UsedBytes,
+	}
+}
+
+func (p *ShareResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
+
+type ShareListResponse struct {
+	Shares []*ShareResponse `json:"shares"`
+}
+
+func (p *ShareListResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/ratelimit"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+)
+
+const SHARE_PASSWORD_HEADER = "X-Share-Password"
+
+type ShareLinkHandler struct {
+	prefix string
+}
+
+func NewShareLinkHandler() *ShareLinkHandler {
+	return &ShareLinkHandler{
+		prefix: path.Join(config.ApiPath, "s") + "/",
+	}
+}
+
+func (hdl *ShareLinkHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Resolve a share link to a signed download url, folders are zipped once and the archive is reused until the folder changes.
+Each redeem reserves one download of the share for the signed key, it counts towards the limit
+as soon as the file starts being served, range requests included, or until the key expires unused.
+Redirects to the download url unless redirect=false, in which case the signed key is returned.
+
+GET /api/nas/v0/s/{share id}?password={optional password}&redirect={false to get signed key}
+*/
+func (hdl *ShareLinkHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	if share.Default == nil {
+		logger.Error("share store is not loaded")
+		http.Error(rw, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := CheckLockout(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, hdl.prefix), "/")
+	password := r.Header.Get(SHARE_PASSWORD_HEADER)
+	if password == "" {
+		password = GetQueryParam("password", r)
+	}
+
+	sh, slot, err := share.Default.Redeem(id, password, ratelimit.ClientIp(r))
+	if err != nil {
+		logger.Errorf("failed to redeem share %s, remote: %s, err: %v", id, r.RemoteAddr, err)
+		rec := &audit.Record{TokenId: shareTokenId(id), Remote: r.RemoteAddr, Operation: audit.OP_SHARE_REDEEM, Outcome: audit.OUTCOME_DENIED, Error: err.Error()}
+		logAuditRecord(r, rec)
+		switch {
+		case errors.Is(err, share.ErrWrongPassword):
+			RecordAuthFailure(r)
+			http.Error(rw, "Password required", http.StatusUnauthorized)
+		case errors.Is(err, share.ErrIpNotAllowed):
+			http.Error(rw, "Not allowed", http.StatusForbidden)
+		case errors.Is(err, share.ErrExpired), errors.Is(err, share.ErrExhausted):
+			http.Error(rw, "Share expired", http.StatusGone)
+		case errors.Is(err, share.ErrNotFound):
+			RecordAuthFailure(r)
+			http.Error(rw, "Share not found", http.StatusNotFound)
+		default:
+			http.Error(rw, "Failed to open share", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// check path exists
+	info, err := os.Stat(sh.FilePath)
+	if err != nil {
+		logger.Errorf("shared path %s does not exit, err: %v", sh.FilePath, err)
+		share.Default.ReleaseSlot(slot.Id)
+		http.Error(rw, "Target not exist", http.StatusNotFound)
+		return
+	}
+
+	res, err := signShare(r.Context(), sh, slot, info.IsDir())
+	logAuditRecord(r, audit.NewRecord(shareTokenId(sh.Id), r.RemoteAddr, audit.OP_SHARE_REDEEM, fs.PublicPath(sh.FilePath), 0, err))
+	if err != nil {
+		logger.Errorf("failed to sign share %s, err: %v", sh.Id, err)
+		share.Default.ReleaseSlot(slot.Id)
+		http.Error(rw, "Failed to get download url", http.StatusNotFound)
+		return
+	}
+	logger.Infof("share %s redeemed, path: %s, previous downloads: %d, remote: %s", sh.Id, sh.FilePath, sh.Downloads, r.RemoteAddr)
+
+	if GetQueryParam("redirect", r) == "false" {
+		res.ToJSON(rw)
+		return
+	}
+	query := url.Values{}
+	query.Set("signed", res.Signed)
+	query.Set("nc", res.Nonce)
+	http.Redirect(rw, r, path.Join(config.ApiPath, "download")+"?"+query.Encode(), http.StatusFound)
+}
+
+const shareTokenPrefix = "share:"
+
+// downloads through a share are attributed to the share instead of the creator token
+func shareTokenId(id string) string {
+	return shareTokenPrefix + id
+}
+
+// sign the shared file for a reserved download, or the archive of a shared folder which is kept for the next requests
+func signShare(ctx context.Context, sh *share.Share, slot *share.Slot, isDir bool) (*DownloadPostResponse, error) {
+	metadata := &auth.SignedMetadata{TokenId: shareTokenId(sh.Id), FilePath: sh.FilePath, ExpAt: slot.ExpAt, Type: auth.SIGN_REGULAR, Bandwidth: sh.Bandwidth, Slot: slot.Id}
+	if isDir {
+		zipPath, err := sharedFolders.Get(ctx, sh)
+		if err != nil {
+			return nil, err
+		}
+		metadata.FilePath = zipPath
+	}
+	signed, nonce, err := auth.DLSigning.Generate(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadPostResponse{
+		Signed: signed,
+		Nonce:  nonce,
+	}, nil
+}
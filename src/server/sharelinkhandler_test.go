@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/ratelimit"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
+)
+
+func setupShareTest(t *testing.T, maxDownloads int) *share.Share {
+	t.Helper()
+	dir := t.TempDir()
+	config.ApiPath = "/api/nas/v0"
+	config.PublicDirectoryRoot = dir
+	config.SignSecret = []byte("0123456789abcdef")
+	authLockout = ratelimit.NewLockout(100, time.Minute, time.Minute)
+
+	store, err := share.NewStore(path.Join(t.TempDir(), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := share.Default
+	share.Default = store
+	t.Cleanup(func() { share.Default = previous })
+
+	filePath := path.Join(dir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sh, err := store.Create("owner", filePath, &share.Options{ExpAt: time.Now().Add(time.Hour).Unix(), MaxDownloads: maxDownloads})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sh
+}
+
+// redeem the share without following the redirect, status and signed key
+func redeemShare(t *testing.T, id string) (int, *DownloadPostResponse) {
+	t.Helper()
+	rw := httptest.NewRecorder()
+	NewShareLinkHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path.Join(config.ApiPath, "s", id)+"?redirect=false", nil))
+	if rw.Code != http.StatusOK {
+		return rw.Code, nil
+	}
+	res := &DownloadPostResponse{}
+	if err := json.NewDecoder(rw.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	}
+	return rw.Code, res
+}
+
+func downloadShare(res *DownloadPostResponse, rangeHeader string) int {
+	query := url.Values{}
+	query.Set("signed", res.Signed)
+	query.Set("nc", res.Nonce)
+	r := httptest.NewRequest(http.MethodGet, path.Join(config.ApiPath, "download")+"?"+query.Encode(), nil)
+	if rangeHeader != "" {
+		r.Header.Set("Range", rangeHeader)
+	}
+	rw := httptest.NewRecorder()
+	NewDownloadHandler().ServeHTTP(rw, r)
+	return rw.Code
+}
+
+func TestShareKeysCannotExceedMaxDownloads(t *testing.T) {
+	sh := setupShareTest(t, 2)
+
+	// redeem every key before downloading any
+	keys := []*DownloadPostResponse{}
+	for i := 0; i < 3; i++ {
+		code, res := redeemShare(t, sh.Id)
+		if code == http.StatusOK {
+			keys = append(keys, res)
+		}
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys for 2 downloads, got %d", len(keys))
+	}
+	for _, res := range keys {
+		if code := downloadShare(res, ""); code != http.StatusOK {
+			t.Fatalf("expected download, got %d", code)
+		}
+	}
+	if code, _ := redeemShare(t, sh.Id); code != http.StatusGone {
+		t.Fatalf("expected share exhausted, got %d", code)
+	}
+}
+
+func TestShareRangeDownloadCounts(t *testing.T) {
+	sh := setupShareTest(t, 1)
+
+	code, res := redeemShare(t, sh.Id)
+	if code != http.StatusOK {
+		t.Fatalf("expected redeem, got %d", code)
+	}
+	if code := downloadShare(res, "bytes=0-"); code != http.StatusPartialContent {
+		t.Fatalf("expected partial content, got %d", code)
+	}
+	if code, _ := redeemShare(t, sh.Id); code != http.StatusGone {
+		t.Fatalf("range download not counted, redeem got %d", code)
+	}
+}
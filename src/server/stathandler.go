@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/jobs"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+)
+
+type StatHandler struct {
+}
+
+func NewStatHandler() *StatHandler {
+	return &StatHandler{}
+}
+
+func (hdl *StatHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Get metadata of a single file or folder, 404 with exists false if it does not exist.
+HEAD returns the same status and ETag without body.
+The checksum field is empty until computed in background, with async it is computed in a background job
+whatever its size and the response is the job result.
+
+GET /api/nas/v0/stat?key={file path}&fields={optional metadata, see dir}&async={true to hash the file in a background job}
+HEAD /api/nas/v0/stat?key={file path}
+*/
+func (hdl *StatHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	queryPath := GetQueryParam("key", r)
+	queryPath = path.Join(queryPath)
+
+	// check permission and get full path
+	fullQueryPath, err := fsPermission.CheckRead(queryPath)
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_STAT, queryPath, err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	fields, err := fs.ParseFields(GetQueryParam("fields", r))
+	if err != nil {
+		logger.Error(err)
+		http.Error(rw, "Invalid fields", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet && GetQueryParam("async", r) == "true" {
+		hdl.submitChecksum(rw, r, fsPermission, queryPath, fullQueryPath, fields)
+		return
+	}
+
+	res := &StatResponse{Path: queryPath}
+	metadata, info, err := fs.StatFileMetadata(fullQueryPath, fields)
+	if os.IsNotExist(err) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		res.ToJSON(rw)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to stat %s, err: %v", fullQueryPath, err)
+		auditOperation(fsPermission, r, audit.OP_STAT, fullQueryPath, 0, err)
+		http.Error(rw, "Failed to read metadata", http.StatusInternalServerError)
+		return
+	}
+
+	res.Exists = true
+	res.Metadata = metadata
+	res.ETag = fs.ETag(info)
+	if info.IsDir() {
+		files, folders, err := fs.CountChildren(fullQueryPath)
+		if err != nil {
+			logger.Errorf("failed to count children of %s, err: %v", fullQueryPath, err)
+		} else {
+			res.Files = &files
+			res.Folders = &folders
+		}
+	}
+
+	rw.Header().Set("ETag", res.ETag)
+	rw.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == res.ETag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	res.ToJSON(rw)
+	auditOperation(fsPermission, r, audit.OP_STAT, fullQueryPath, 0, nil)
+}
+
+// Hash a file in a job, the result is the stat response with the checksum filled in.
+func (hdl *StatHandler) submitChecksum(rw http.ResponseWriter, r *http.Request, fsPermission *auth.FsPermission, queryPath string, fullQueryPath string, fields fs.Fields) {
+	logger := middleware.RequestLog(r)
+	info, err := os.Stat(fullQueryPath)
+	if err != nil || !info.Mode().IsRegular() {
+		logger.Infof("checksum requested for %s, err: %v", fullQueryPath, err)
+		http.Error(rw, "Not a file", http.StatusNotFound)
+		return
+	}
+
+	origin := originOf(r)
+	job, err := jobs.Default.Submit(fsPermission.Id(), "checksum", func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		sum, err := fs.FileChecksum(ctx, fullQueryPath, func(read int64, total int64, current string) {
+			if total > 0 {
+				job.SetProgress(int(read * 100 / total))
+			}
+		})
+		if err != nil {
+			origin.auditOperation(fsPermission, audit.OP_STAT, fullQueryPath, 0, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to hash %s", queryPath)
+		}
+		delete(fields, fs.FIELD_CHECKSUM)
+		metadata, info, err := fs.StatFileMetadata(fullQueryPath, fields)
+		if err != nil {
+			origin.auditOperation(fsPermission, audit.OP_STAT, fullQueryPath, 0, err)
+			return nil, fmt.Errorf("failed to read metadata of %s", queryPath)
+		}
+		metadata.Checksum = sum
+		origin.auditOperation(fsPermission, audit.OP_STAT, fullQueryPath, 0, nil)
+		return &StatResponse{Exists: true, Path: queryPath, ETag: fs.ETag(info), Metadata: metadata}, nil
+	})
+	if err != nil {
+		logger.Errorf("failed to submit checksum job, err: %v", err)
+		http.Error(rw, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+	res := &JobResponse{job.Snapshot()}
+	res.ToJSON(rw)
+	logger.Infof("checksum job %s submitted by id: %s, path: %s, remote: %s", job.Id(), fsPermission.Id(), fullQueryPath, r.RemoteAddr)
+}
+
+type StatResponse struct {
+	Exists   bool             `json:"exists"`
+	Path     string           `json:"path"`
+	ETag     string           `json:"etag,omitempty"`
+	Metadata *fs.FileMetadata `json:"metadata,omitempty"`
+	Files    *int             `json:"files,omitempty"`
+	Folders  *int             `json:"folders,omitempty"`
+}
+
+func (p *StatResponse) ToJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(p)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/thumb"
+)
+
+// browsers may reuse a thumbnail for a day, then revalidate with the ETag
+const thumbCacheControl = "private, max-age=86400"
+
+type ThumbHandler struct {
+}
+
+func NewThumbHandler() *ThumbHandler {
+	return &ThumbHandler{}
+}
+
+func (hdl *ThumbHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if thumb.Default == nil {
+		middleware.RequestLog(r).Error("thumbnail generator is not started")
+		http.Error(rw, "Thumbnails unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method == http.MethodGet {
+		hdl.handleGet(rw, r)
+		return
+	}
+	rw.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+/*
+Get the thumbnail of a JPEG, PNG, GIF or WebP image, the size is small, medium or large
+
+GET /api/nas/v0/thumb?key={file path}&size={optional thumbnail size, small by default}
+*/
+func (hdl *ThumbHandler) handleGet(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	fsPermission, err := ValidateJwtAuthorization(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	queryPath := GetQueryParam("key", r)
+	queryPath = path.Join(queryPath)
+
+	// check permission and get full path
+	fullQueryPath, err := fsPermission.CheckRead(queryPath)
+	if err != nil {
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_THUMB, queryPath, err)
+		http.Error(rw, "No permission", http.StatusForbidden)
+		return
+	}
+
+	size, err := thumb.ParseSize(GetQueryParam("size", r))
+	if err != nil {
+		http.Error(rw, "Invalid size", http.StatusBadRequest)
+		return
+	}
+
+	t, err := thumb.Default.Get(r.Context(), fullQueryPath, size)
+	if err != nil {
+		logger.Errorf("failed to get thumbnail of %s, err: %v", fullQueryPath, err)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(rw, "File does not exist", http.StatusNotFound)
+		case errors.Is(err, thumb.ErrNotImage), errors.Is(err, thumb.ErrTooLarge):
+			http.Error(rw, "No thumbnail", http.StatusUnsupportedMediaType)
+		default:
+			http.Error(rw, "Failed to create thumbnail", http.StatusInternalServerError)
+		}
+		return
+	}
+	thumb.Default.Touch(t)
+
+	rw.Header().Set("ETag", t.ETag)
+	rw.Header().Set("Cache-Control", thumbCacheControl)
+	if r.Header.Get("If-None-Match") == t.ETag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Type", t.ContentType)
+	http.ServeFile(rw, r, t.FilePath)
+}
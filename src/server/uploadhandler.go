@@ -2,14 +2,28 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"path"
+	"strings"
 
-	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/audit"
+	"github.com/lyokalita/naspublic.ftserver/src/auth"
+	"github.com/lyokalita/naspublic.ftserver/src/bandwidth"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/events"
 	"github.com/lyokalita/naspublic.ftserver/src/fs"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/middleware"
+	"github.com/lyokalita/naspublic.ftserver/src/ratelimit"
+	"github.com/lyokalita/naspublic.ftserver/src/share"
 	"github.com/lyokalita/naspublic.ftserver/src/validate"
+	"github.com/lyokalita/naspublic.ftserver/src/webhook"
 )
 
 type UploadHandler struct {
@@ -28,14 +42,25 @@ func (hdl *UploadHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 }
 
 /*
-Upload a file
+Upload files into a folder, or upload into the folder of a dropbox link where the file is renamed if the name is taken.
+Every "uploadFile" part of the multipart body is streamed to disk in turn, so many files or a whole folder can be sent at once.
+A file name may hold a relative path such as "photos/2021/a.jpg" from a folder upload, missing folders are created.
+Responds with the result of each file, 200 if all files are saved, 207 if some are not,
+or the status of the file when the only file sent is not saved.
 
-POST /api/nas/v0/upload?key={file path}
+POST /api/nas/v0/upload?key={folder path}&op={optional operation id for progress events}
+POST /api/nas/v0/upload?dropbox={share id}&password={optional password, or header X-Share-Password}
 */
 func (hdl *UploadHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
+	logger := middleware.RequestLog(r)
+	if id := GetQueryParam("dropbox", r); id != "" {
+		hdl.handleDropbox(rw, r, id)
+		return
+	}
+
 	fsPermission, err := ValidateJwtAuthorization(rw, r)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
 		return
 	}
 
@@ -45,96 +70,390 @@ func (hdl *UploadHandler) handlePost(rw http.ResponseWriter, r *http.Request) {
 	// check permission and get full directory
 	fullQueryPath, err := fsPermission.CheckWrite(queryDir)
 	if err != nil {
-		log.Errorf("%v, err: %v", *fsPermission, err)
+		logger.Errorf("%s, err: %v", fsPermission.String(), err)
+		auditDenied(fsPermission, r, audit.OP_UPLOAD, queryDir, err)
 		http.Error(rw, "No permission", http.StatusForbidden)
 		return
 	}
 
-	// begin progress remote data
-	log.Debugf("handle file upload request full path: %s, remote: %s", fullQueryPath, r.RemoteAddr)
-	ctx := r.Context()
-	cancelChan := make(chan int)
-	responseChan := make(chan *UploadResponse)
-	var partSize int64 = 10 << 20
-
-	// fetch remote data
-	r.ParseMultipartForm(partSize)
-	f_in, header, err := r.FormFile("uploadFile")
+	reader, err := r.MultipartReader()
 	if err != nil {
-		log.Errorf("failed to retrieve file, err: ", err)
+		logger.Errorf("failed to read multipart body, err: %v", err)
 		http.Error(rw, "Invalid file", http.StatusBadRequest)
 		return
 	}
-	defer f_in.Close()
-	log.Infof("Upload File: %s, File Size: %v, MIME Header: %v", header.Filename, header.Size, header.Header)
+	logger.Debugf("handle file upload request full path: %s, remote: %s", fullQueryPath, r.RemoteAddr)
 
-	// check file name length
-	if len(header.Filename) > 250 {
-		log.Errorf("file name is too long: %d", len(header.Filename))
-		http.Error(rw, "File name too long", http.StatusBadRequest)
-		return
+	rootPath, _ := fsPermission.CheckWrite("/")
+	target := &uploadTarget{
+		TokenId:      fsPermission.Id(),
+		Bandwidth:    fsPermission.Bandwidth(),
+		Operation:    audit.OP_UPLOAD,
+		WebhookEvent: webhook.EVENT_UPLOAD_COMPLETED,
 	}
+	progress := newUploadProgress(r, target.TokenId)
+	rw.Header().Set(OPERATION_ID_HEADER, progress.reporter.Id())
 
-	// check path valid
-	destinationFilePath := path.Join(fullQueryPath, header.Filename)
-	if !validate.IsPathInclusive(fullQueryPath, destinationFilePath) {
-		log.Errorf("invalid file name, %s", destinationFilePath)
-		http.Error(rw, "Invalid file name", http.StatusBadRequest)
+	res := &UploadListResponse{Files: []*UploadFileResult{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Errorf("failed to read next part, remote: %s, err: %v", r.RemoteAddr, err)
+			res.add(&UploadFileResult{Status: UPLOAD_FAILED, Error: "broken request body", code: http.StatusBadRequest})
+			break
+		}
+		if part.FormName() != "uploadFile" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(res.Files) >= config.UploadMaxFiles {
+			part.Close()
+			res.add(&UploadFileResult{Name: part.FileName(), Status: UPLOAD_FAILED, Error: "too many files", code: http.StatusRequestEntityTooLarge})
+			break
+		}
+		res.add(hdl.saveFilePart(r, fsPermission, target, progress, part, queryDir, fullQueryPath, rootPath))
+		part.Close()
+	}
+
+	if len(res.Files) == 0 {
+		http.Error(rw, "Invalid file", http.StatusBadRequest)
 		return
 	}
+	progress.finish(res.Failed == 0)
+	logger.Infof("upload of %d files, failed: %d, path: %s, remote: %s", len(res.Files), res.Failed, fullQueryPath, r.RemoteAddr)
+	res.write(rw)
+}
+
+// check the name of one file of the request and stream it to the folder
+func (hdl *UploadHandler) saveFilePart(r *http.Request, fsPermission *auth.FsPermission, target *uploadTarget, progress *uploadProgress, part *multipart.Part, queryDir string, fullQueryPath string, rootPath string) *UploadFileResult {
+	logger := middleware.RequestLog(r)
+	relativePath := uploadRelativePath(part.Header, part.FileName())
+	result := &UploadFileResult{Name: relativePath}
+
+	// check each component of the path
+	destinationFilePath := path.Join(fullQueryPath, relativePath)
+	if !validate.IsValidRelativePath(relativePath) || !validate.IsPathInclusive(fullQueryPath, destinationFilePath) {
+		logger.Errorf("invalid file name: %q", relativePath)
+		return result.fail(UPLOAD_INVALID, "invalid file name", http.StatusBadRequest)
+	}
 
 	// check file exists
-	_, err = os.Stat(destinationFilePath)
+	_, err := os.Stat(destinationFilePath)
 	if err == nil {
-		log.Errorf("file already exists, %s", destinationFilePath)
-		http.Error(rw, "File already exists", http.StatusConflict)
+		logger.Errorf("file already exists, %s", destinationFilePath)
+		auditOperation(fsPermission, r, audit.OP_UPLOAD, destinationFilePath, 0, os.ErrExist)
+		return result.fail(UPLOAD_EXISTS, "file already exists", http.StatusConflict)
+	}
+
+	// create missing folders of the path within the token directory
+	created, err := fs.MkdirUnder(rootPath, path.Dir(destinationFilePath))
+	if created != "" {
+		treeChanged(created)
+		webhook.Emit(&webhook.Event{Type: webhook.EVENT_DIR_CREATED, TokenId: fsPermission.Id(), Path: fs.PublicPath(created), Remote: r.RemoteAddr})
+	}
+	if err != nil {
+		logger.Errorf("failed to create folders of %s, err: %v", destinationFilePath, err)
+		auditOperation(fsPermission, r, audit.OP_UPLOAD, destinationFilePath, 0, err)
+		return result.fail(UPLOAD_FAILED, "unable to create folder", http.StatusConflict)
+	}
+
+	written, err := writeUpload(r, target, progress, part, relativePath, destinationFilePath)
+	result.Size = written
+	if os.IsExist(err) {
+		return result.fail(UPLOAD_EXISTS, "file already exists", http.StatusConflict)
+	}
+	if err != nil {
+		return result.fail(UPLOAD_FAILED, "unable to upload file", http.StatusNotFound)
+	}
+	result.Path = path.Join(queryDir, relativePath)
+	result.Status = UPLOAD_OK
+	result.code = http.StatusOK
+	return result
+}
+
+/*
+Stream a file to destinationFilePath, which must not exist, then record and announce it
+
+return:
+- number of bytes written
+*/
+func writeUpload(r *http.Request, target *uploadTarget, progress *uploadProgress, reader io.Reader, name string, destinationFilePath string) (int64, error) {
+	uploader := newUploader(r, target, progress, reader, name)
+	metrics.ActiveUploads.Inc()
+	totalWriteSize, err := uploader.WriteTo(destinationFilePath)
+	metrics.ActiveUploads.Dec()
+	uploadFinished(r, target, progress, destinationFilePath, totalWriteSize, err)
+	return totalWriteSize, err
+}
+
+/*
+Same as writeUpload, the file is renamed if fileName is taken in dir
+
+return:
+- full path of the file
+- number of bytes written
+*/
+func writeUploadUnique(r *http.Request, target *uploadTarget, progress *uploadProgress, reader io.Reader, dir string, fileName string) (string, int64, error) {
+	uploader := newUploader(r, target, progress, reader, fileName)
+	metrics.ActiveUploads.Inc()
+	destinationFilePath, totalWriteSize, err := uploader.WriteUnique(dir, fileName)
+	metrics.ActiveUploads.Dec()
+	if err != nil {
+		destinationFilePath = path.Join(dir, fileName)
+	}
+	uploadFinished(r, target, progress, destinationFilePath, totalWriteSize, err)
+	return destinationFilePath, totalWriteSize, err
+}
+
+func newUploader(r *http.Request, target *uploadTarget, progress *uploadProgress, reader io.Reader, name string) *fs.StreamUploader {
+	uploader := fs.NewStreamUploader(reader, uploadPartSize)
+	uploader.Limiter = bandwidth.Default.For(r.Context(), target.TokenId, target.Bandwidth)
+	uploader.OnProgress = func(written int64) {
+		progress.running(name, written)
+	}
+	return uploader
+}
+
+// record the outcome of a file, err is nil on success
+func uploadFinished(r *http.Request, target *uploadTarget, progress *uploadProgress, destinationFilePath string, totalWriteSize int64, err error) {
+	logger := middleware.RequestLog(r)
+	metrics.UploadedBytes.Add(float64(totalWriteSize))
+	progress.fileDone(totalWriteSize)
+	if err != nil {
+		logger.Errorf("failed to write to file %s, err: %v", destinationFilePath, err)
+		auditOperationById(target.TokenId, r, target.Operation, destinationFilePath, totalWriteSize, err)
 		return
 	}
 
-	// save file
-	fileWriter := fs.NewFileUploader(f_in, header.Size, partSize, cancelChan)
-	go func() {
-		defer close(responseChan)
-		totalWriteSize, err := fileWriter.WriteTo(destinationFilePath)
+	logger.Infof("successfully wrote to file %s with %d bytes", destinationFilePath, totalWriteSize)
+	pathChanged(destinationFilePath)
+	auditOperationById(target.TokenId, r, target.Operation, destinationFilePath, totalWriteSize, nil)
+	webhook.Emit(&webhook.Event{Type: target.WebhookEvent, TokenId: target.TokenId, Path: fs.PublicPath(destinationFilePath), Size: totalWriteSize, Remote: r.RemoteAddr})
+}
+
+// progress events of all files of a request, the total is the size of the request body
+type uploadProgress struct {
+	reporter  *events.Reporter
+	total     int64
+	done      int64
+	filesDone int
+}
+
+func newUploadProgress(r *http.Request, tokenId string) *uploadProgress {
+	return &uploadProgress{
+		reporter: events.Progress.NewReporter(tokenId, "upload", GetOperationId(r)),
+		total:    r.ContentLength,
+	}
+}
+
+func (p *uploadProgress) running(name string, written int64) {
+	p.reporter.Running(&events.ProgressEvent{Bytes: p.done + written, Total: p.total, PartsDone: p.filesDone, Current: name})
+}
+
+func (p *uploadProgress) fileDone(written int64) {
+	p.done += written
+	p.filesDone++
+}
+
+func (p *uploadProgress) finish(ok bool) {
+	e := &events.ProgressEvent{Bytes: p.done, Total: p.total, PartsDone: p.filesDone, PartsTotal: p.filesDone}
+	if ok {
+		p.reporter.Done(e)
+	} else {
+		p.reporter.Failed(e)
+	}
+}
+
+// upload into the folder of a dropbox link, no token required
+func (hdl *UploadHandler) handleDropbox(rw http.ResponseWriter, r *http.Request, id string) {
+	logger := middleware.RequestLog(r)
+	if share.Default == nil {
+		logger.Error("share store is not loaded")
+		http.Error(rw, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := CheckLockout(rw, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	password := r.Header.Get(SHARE_PASSWORD_HEADER)
+	if password == "" {
+		password = GetQueryParam("password", r)
+	}
+
+	// the size of the file is not known before it is read, the body length is reserved and the rest given back
+	if r.ContentLength < 0 {
+		http.Error(rw, "Length required", http.StatusLengthRequired)
+		return
+	}
+	reserved := r.ContentLength
+	sh, err := share.Default.Reserve(id, password, ratelimit.ClientIp(r), reserved)
+	if err != nil {
+		logger.Errorf("failed to upload to dropbox %s, remote: %s, err: %v", id, r.RemoteAddr, err)
+		rec := &audit.Record{TokenId: shareTokenId(id), Remote: r.RemoteAddr, Operation: audit.OP_DROPBOX, Bytes: reserved, Outcome: audit.OUTCOME_DENIED, Error: err.Error()}
+		logAuditRecord(r, rec)
+		switch {
+		case errors.Is(err, share.ErrWrongPassword):
+			RecordAuthFailure(r)
+			http.Error(rw, "Password required", http.StatusUnauthorized)
+		case errors.Is(err, share.ErrIpNotAllowed):
+			http.Error(rw, "Not allowed", http.StatusForbidden)
+		case errors.Is(err, share.ErrExpired):
+			http.Error(rw, "Share expired", http.StatusGone)
+		case errors.Is(err, share.ErrFileTooLarge), errors.Is(err, share.ErrQuotaExceeded):
+			http.Error(rw, "File too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, share.ErrNotFound):
+			RecordAuthFailure(r)
+			http.Error(rw, "Share not found", http.StatusNotFound)
+		default:
+			http.Error(rw, "Failed to open share", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// fetch remote data, only the first file is taken and folders in its name are dropped
+	part, err := getUploadPart(r)
+	if err != nil {
+		logger.Errorf("failed to read file for dropbox %s, err: %v", sh.Id, err)
+		share.Default.Release(sh.Id, reserved)
+		http.Error(rw, "Invalid file", http.StatusBadRequest)
+		return
+	}
+	defer part.Close()
+	fileName := part.FileName()
+	if !validate.IsValidFileName(fileName) {
+		logger.Errorf("invalid file name for dropbox %s: %q", sh.Id, fileName)
+		share.Default.Release(sh.Id, reserved)
+		http.Error(rw, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	// never overwrite, the file takes a free name in the folder once complete
+	target := &uploadTarget{
+		TokenId:      shareTokenId(sh.Id),
+		Bandwidth:    sh.Bandwidth,
+		Operation:    audit.OP_DROPBOX,
+		WebhookEvent: webhook.EVENT_DROPBOX_RECEIVED,
+	}
+	progress := newUploadProgress(r, target.TokenId)
+	rw.Header().Set(OPERATION_ID_HEADER, progress.reporter.Id())
+	destinationFilePath, written, err := writeUploadUnique(r, target, progress, part, sh.FilePath, fileName)
+	if err != nil {
+		share.Default.Release(sh.Id, reserved)
+	} else {
+		share.Default.Release(sh.Id, reserved-written)
+	}
+	progress.finish(err == nil)
+
+	res := &UploadListResponse{Files: []*UploadFileResult{}}
+	result := &UploadFileResult{Name: fileName, Size: written}
+	if err != nil {
+		result.fail(UPLOAD_FAILED, "unable to upload file", http.StatusNotFound)
+	} else {
+		result.Path = path.Base(destinationFilePath)
+		result.Status = UPLOAD_OK
+		result.code = http.StatusOK
+	}
+	res.add(result)
+	res.write(rw)
+}
+
+// who receives an upload, and how it is recorded
+type uploadTarget struct {
+	TokenId      string
+	Bandwidth    int64
+	Operation    string
+	WebhookEvent string
+}
+
+// first file part of the multipart body, other fields before it are skipped
+func getUploadPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
 		if err != nil {
-			log.Errorf("failed to write to file %s, err: %v", destinationFilePath, err)
-			err = os.Remove(destinationFilePath)
-			if err != nil {
-				log.Errorf("failed to clean file %s", destinationFilePath)
-			}
-			responseChan <- &UploadResponse{
-				Status:  -1,
-				Message: "unable to upload file",
-			}
-		} else {
-			log.Infof("successfully wrote to file %s with %d bytes", destinationFilePath, totalWriteSize)
-			responseChan <- &UploadResponse{
-				Status:  0,
-				Message: "success",
-			}
+			return nil, err
 		}
-	}()
-
-	select {
-	case writerResponse := <-responseChan:
-		log.Infof("response value - success: %d, message: %s", writerResponse.Status, writerResponse.Message)
-		if writerResponse.Status == 0 {
-			rw.Write([]byte("Upload successfully"))
-		} else {
-			http.Error(rw, "Upload failed", http.StatusNotFound)
+		if part.FormName() == "uploadFile" && part.FileName() != "" {
+			return part, nil
 		}
-	case <-ctx.Done():
-		cancelChan <- 1
-		log.Infof("request is cancelled, %s", destinationFilePath)
+		part.Close()
 	}
 }
 
-type UploadResponse struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+// file name with its folders, the multipart reader only keeps the base name
+func uploadRelativePath(header textproto.MIMEHeader, fileName string) string {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return fileName
+	}
+	return strings.TrimPrefix(params["filename"], "./")
 }
 
-func (p *UploadResponse) ToJSON(w io.Writer) error {
+// progress is reported each time this many bytes of a file are written
+const uploadPartSize int64 = 10 << 20
+
+const (
+	UPLOAD_OK      = "ok"
+	UPLOAD_EXISTS  = "exists"
+	UPLOAD_INVALID = "invalid"
+	UPLOAD_FAILED  = "failed"
+)
+
+type UploadListResponse struct {
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Files     []*UploadFileResult `json:"files"`
+}
+
+func (p *UploadListResponse) add(result *UploadFileResult) {
+	p.Files = append(p.Files, result)
+	if result.Status == UPLOAD_OK {
+		p.Succeeded++
+	} else {
+		p.Failed++
+	}
+}
+
+// status is 200 if all files are saved, the status of the file if it is the only one, 207 otherwise
+func (p *UploadListResponse) write(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	switch {
+	case p.Failed == 0:
+	case len(p.Files) == 1:
+		rw.WriteHeader(p.Files[0].code)
+	default:
+		rw.WriteHeader(http.StatusMultiStatus)
+	}
+	p.ToJSON(rw)
+}
+
+func (p *UploadListResponse) ToJSON(w io.Writer) error {
 	encoder := json.NewEncoder(w)
 	return encoder.Encode(p)
 }
+
+type UploadFileResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	code   int
+}
+
+func (p *UploadFileResult) fail(status string, message string, code int) *UploadFileResult {
+	p.Status = status
+	p.Error = message
+	p.code = code
+	return p
+}
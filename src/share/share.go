@@ -0,0 +1,425 @@
+package share
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const idLength = 10
+
+// a download reserved by Redeem is given back if it is not started within this time
+const slotTTL = 10 * time.Minute
+
+const (
+	SHARE_DOWNLOAD = "download"
+	SHARE_DROPBOX  = "dropbox"
+)
+
+var (
+	ErrNotFound      = fmt.Errorf("share not found")
+	ErrExpired       = fmt.Errorf("share expired")
+	ErrExhausted     = fmt.Errorf("share download limit reached")
+	ErrIpNotAllowed  = fmt.Errorf("ip not allowed")
+	ErrWrongPassword = fmt.Errorf("wrong password")
+	ErrFileTooLarge  = fmt.Errorf("file exceeds size limit")
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+)
+
+/*
+A link to a file or folder.
+- download: outsiders can download the file or zipped folder
+- dropbox: outsiders can only upload into the folder
+*/
+type Share struct {
+	Id           string   `json:"id"`
+	Type         string   `json:"type"`
+	Owner        string   `json:"owner"`
+	FilePath     string   `json:"filePath"`
+	PasswordHash string   `json:"passwordHash,omitempty"`
+	ExpAt        int64    `json:"expAt"`
+	MaxDownloads int      `json:"maxDownloads"`
+	Downloads    int      `json:"downloads"`
+	AllowedIps   []string `json:"allowedIps,omitempty"`
+	Bandwidth    int64    `json:"bandwidth,omitempty"`
+	CreatedAt    int64    `json:"createdAt"`
+	MaxFileSize  int64    `json:"maxFileSize,omitempty"`
+	Quota        int64    `json:"quota,omitempty"`
+	UsedBytes    int64    `json:"usedBytes,omitempty"`
+}
+
+// Options of a new share, zero values mean no limit
+type Options struct {
+	Type         string
+	Password     string
+	ExpAt        int64
+	MaxDownloads int
+	AllowedIps   []string
+	Bandwidth    int64
+	MaxFileSize  int64
+	Quota        int64
+}
+
+func (s *Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// check ip against allowed ips and networks in CIDR notation
+func (s *Share) allowIp(ip string) bool {
+	if len(s.AllowedIps) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, allowed := range s.AllowedIps {
+		if allowed == ip {
+			return true
+		}
+		_, network, err := net.ParseCIDR(allowed)
+		if err == nil && parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate an allowed ip entry, either a single ip or a network in CIDR notation.
+func IsValidIpRule(rule string) bool {
+	if net.ParseIP(rule) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(rule)
+	return err == nil
+}
+
+// Shares persisted to a json file, the file is rewritten on every change
+type Store struct {
+	mu       sync.Mutex
+	filePath string
+	shares   map[string]*Share
+	slots    map[string]*Slot // by slot id
+}
+
+// A download of a share reserved by Redeem, consumed by UseSlot or given back once it expires
+type Slot struct {
+	Id      string
+	ShareId string
+	ExpAt   int64
+}
+
+var Default *Store
+
+func Init() {
+	s, err := NewStore(config.ShareStorePath)
+	if err != nil {
+		log.Errorf("failed to load share store, err: %v", err)
+		return
+	}
+	Default = s
+	log.Debugf("successfully loaded %d shares from %s", len(s.shares), config.ShareStorePath)
+}
+
+func NewStore(filePath string) (*Store, error) {
+	err := os.MkdirAll(path.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		filePath: filePath,
+		shares:   map[string]*Share{},
+		slots:    map[string]*Slot{},
+	}
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, &s.shares)
+	if err != nil {
+		return nil, err
+	}
+	// shares saved before dropbox links were added have no type
+	for _, sh := range s.shares {
+		if sh.Type == "" {
+			sh.Type = SHARE_DOWNLOAD
+		}
+	}
+	return s, nil
+}
+
+// Create a share, password is hashed before it is stored.
+func (s *Store) Create(owner string, filePath string, opts *Options) (*Share, error) {
+	sh := &Share{
+		Id:           string(utils.GetRandomBytes(idLength)),
+		Type:         opts.Type,
+		Owner:        owner,
+		FilePath:     filePath,
+		ExpAt:        opts.ExpAt,
+		MaxDownloads: opts.MaxDownloads,
+		AllowedIps:   opts.AllowedIps,
+		Bandwidth:    opts.Bandwidth,
+		CreatedAt:    time.Now().Unix(),
+		MaxFileSize:  opts.MaxFileSize,
+		Quota:        opts.Quota,
+	}
+	if sh.Type == "" {
+		sh.Type = SHARE_DOWNLOAD
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		sh.PasswordHash = string(hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.shares[sh.Id] = sh
+	err := s.saveLocked()
+	if err != nil {
+		delete(s.shares, sh.Id)
+		return nil, err
+	}
+	return sh, nil
+}
+
+/*
+Check a download share can be opened by ip with password and reserve one of its downloads.
+The slot is counted against the download limit until it expires, so that keys signed
+for it can never go over the limit; it is consumed by UseSlot when the download starts.
+
+return:
+- copy of the share
+- the reserved download, its expiry is the latest expiry of the key signed for it
+*/
+func (s *Store) Redeem(id string, password string, ip string) (*Share, *Slot, error) {
+	err := s.authorize(id, SHARE_DOWNLOAD, password, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	s.pruneSlotsLocked()
+	if sh.MaxDownloads > 0 && sh.Downloads+s.heldLocked(id) >= sh.MaxDownloads {
+		return nil, nil, ErrExhausted
+	}
+	slot := &Slot{Id: string(utils.GetRandomBytes(16)), ShareId: id, ExpAt: time.Now().Add(slotTTL).Unix()}
+	if slot.ExpAt > sh.ExpAt {
+		slot.ExpAt = sh.ExpAt
+	}
+	s.slots[slot.Id] = slot
+	copied := *sh
+	copiedSlot := *slot
+	return &copied, &copiedSlot, nil
+}
+
+/*
+Count the download of a reserved slot, called once the file starts being served, whatever part of it is requested.
+
+return:
+- false if the slot is unknown, already used or expired
+*/
+func (s *Store) UseSlot(slotId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot, ok := s.slots[slotId]
+	if !ok {
+		return false
+	}
+	delete(s.slots, slotId)
+	sh, ok := s.shares[slot.ShareId]
+	if !ok || slot.ExpAt <= time.Now().Unix() {
+		return false
+	}
+	sh.Downloads++
+	err := s.saveLocked()
+	if err != nil {
+		log.Errorf("failed to save share %s, err: %v", sh.Id, err)
+	}
+	return true
+}
+
+// Give back a slot whose key could not be signed.
+func (s *Store) ReleaseSlot(slotId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.slots, slotId)
+}
+
+// number of unexpired slots of a share
+func (s *Store) heldLocked(id string) int {
+	n := 0
+	for _, slot := range s.slots {
+		if slot.ShareId == id {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Store) pruneSlotsLocked() {
+	now := time.Now().Unix()
+	for id, slot := range s.slots {
+		if slot.ExpAt <= now {
+			delete(s.slots, id)
+		}
+	}
+}
+
+// Whether a share exists and is not expired.
+func (s *Store) Exists(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	return ok && sh.ExpAt > time.Now().Unix()
+}
+
+/*
+Check a dropbox share accepts a file of size from ip with password and reserve its quota.
+Call Release with the same size if the upload fails.
+
+return:
+- copy of the share
+*/
+func (s *Store) Reserve(id string, password string, ip string, size int64) (*Share, error) {
+	err := s.authorize(id, SHARE_DROPBOX, password, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if sh.MaxFileSize > 0 && size > sh.MaxFileSize {
+		return nil, ErrFileTooLarge
+	}
+	if sh.Quota > 0 && sh.UsedBytes+size > sh.Quota {
+		return nil, ErrQuotaExceeded
+	}
+	sh.UsedBytes += size
+	err = s.saveLocked()
+	if err != nil {
+		sh.UsedBytes -= size
+		return nil, err
+	}
+	copied := *sh
+	return &copied, nil
+}
+
+// Give back quota reserved for a failed upload.
+func (s *Store) Release(id string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok {
+		return
+	}
+	sh.UsedBytes -= size
+	if sh.UsedBytes < 0 {
+		sh.UsedBytes = 0
+	}
+	err := s.saveLocked()
+	if err != nil {
+		log.Errorf("failed to save share %s, err: %v", id, err)
+	}
+}
+
+// check share type, expiry, ip and password
+func (s *Store) authorize(id string, shareType string, password string, ip string) error {
+	s.mu.Lock()
+	sh, ok := s.shares[id]
+	if !ok || sh.Type != shareType {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	if sh.ExpAt <= time.Now().Unix() {
+		s.mu.Unlock()
+		return ErrExpired
+	}
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		s.mu.Unlock()
+		return ErrExhausted
+	}
+	if !sh.allowIp(ip) {
+		s.mu.Unlock()
+		return ErrIpNotAllowed
+	}
+	hash := sh.PasswordHash
+	s.mu.Unlock()
+
+	// compare outside the lock, bcrypt is slow on purpose
+	if hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// Return shares created by owner.
+func (s *Store) List(owner string) []*Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*Share{}
+	for _, sh := range s.shares {
+		if sh.Owner == owner {
+			copied := *sh
+			list = append(list, &copied)
+		}
+	}
+	return list
+}
+
+// Delete a share created by owner.
+func (s *Store) Delete(owner string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok || sh.Owner != owner {
+		return ErrNotFound
+	}
+	delete(s.shares, id)
+	return s.saveLocked()
+}
+
+func (s *Store) pruneLocked() {
+	now := time.Now().Unix()
+	for id, sh := range s.shares {
+		if sh.ExpAt <= now {
+			delete(s.shares, id)
+		}
+	}
+}
+
+// write then rename so that a crash never leaves a partial file
+func (s *Store) saveLocked() error {
+	b, err := json.Marshal(s.shares)
+	if err != nil {
+		return err
+	}
+	tmp := s.filePath + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filePath)
+}
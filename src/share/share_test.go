@@ -0,0 +1,79 @@
+package share
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func newTestShare(t *testing.T, maxDownloads int) (*Store, *Share) {
+	t.Helper()
+	s, err := NewStore(path.Join(t.TempDir(), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := s.Create("owner", "/tmp/file.txt", &Options{ExpAt: time.Now().Add(time.Hour).Unix(), MaxDownloads: maxDownloads})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, sh
+}
+
+func TestRedeemReservesDownloads(t *testing.T) {
+	s, sh := newTestShare(t, 2)
+
+	// keys redeemed before any download starts still count towards the limit
+	_, first, err := s.Redeem(sh.Id, "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := s.Redeem(sh.Id, "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Redeem(sh.Id, "", "127.0.0.1"); err != ErrExhausted {
+		t.Fatalf("expected ErrExhausted over the limit, got %v", err)
+	}
+
+	if !s.UseSlot(first.Id) {
+		t.Fatal("reserved slot refused")
+	}
+	if s.UseSlot(first.Id) {
+		t.Fatal("slot used twice")
+	}
+
+	// a released slot is given back
+	s.ReleaseSlot(second.Id)
+	if s.UseSlot(second.Id) {
+		t.Fatal("released slot used")
+	}
+	_, third, err := s.Redeem(sh.Id, "", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("released slot not given back, err: %v", err)
+	}
+	if !s.UseSlot(third.Id) {
+		t.Fatal("reserved slot refused")
+	}
+	if _, _, err := s.Redeem(sh.Id, "", "127.0.0.1"); err != ErrExhausted {
+		t.Fatalf("expected ErrExhausted after the downloads, got %v", err)
+	}
+}
+
+func TestExpiredSlotIsGivenBack(t *testing.T) {
+	s, sh := newTestShare(t, 1)
+
+	_, slot, err := s.Redeem(sh.Id, "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.slots[slot.Id].ExpAt = time.Now().Unix() - 1
+	s.mu.Unlock()
+
+	if s.UseSlot(slot.Id) {
+		t.Fatal("expired slot used")
+	}
+	if _, _, err := s.Redeem(sh.Id, "", "127.0.0.1"); err != nil {
+		t.Fatalf("expired slot not given back, err: %v", err)
+	}
+}
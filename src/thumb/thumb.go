@@ -0,0 +1,423 @@
+package thumb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/metrics"
+	"github.com/lyokalita/naspublic.ftserver/src/semaphore"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	SIZE_SMALL  = "small"
+	SIZE_MEDIUM = "medium"
+	SIZE_LARGE  = "large"
+)
+
+// longest side in pixels of each size
+var sizes = map[string]int{
+	SIZE_SMALL:  128,
+	SIZE_MEDIUM: 256,
+	SIZE_LARGE:  512,
+}
+
+const jpegQuality = 80
+
+// images waiting for Prepare, more are skipped and generated on first request
+const prepareQueueSize = 256
+
+var (
+	ErrNotImage = fmt.Errorf("not a supported image")
+	ErrTooLarge = fmt.Errorf("image too large")
+	ErrSize     = fmt.Errorf("unknown thumbnail size")
+)
+
+// Thumbnail service, nil if thumbnails are disabled
+var Default *Generator
+
+// A generated thumbnail in the cache
+type Thumbnail struct {
+	FilePath    string
+	ContentType string
+	ETag        string
+}
+
+/*
+Generate thumbnails of images and cache them on disk.
+Cached names carry the size and modification time of the original, so a modified image never serves a stale thumbnail.
+*/
+type Generator struct {
+	dir       string
+	maxPixels int64
+	sem       *semaphore.Semaphore
+	mu        sync.Mutex
+	inflight  map[string]*call
+	prepare   chan string
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// a generation shared by concurrent requests of the same thumbnail
+type call struct {
+	done  chan struct{}
+	thumb *Thumbnail
+	err   error
+}
+
+func Init() {
+	if !config.ThumbEnabled {
+		log.Info("thumbnails are disabled")
+		return
+	}
+	g, err := NewGenerator(config.ThumbDirectory, config.ThumbMaxPixels, config.NumCore)
+	if err != nil {
+		log.Errorf("failed to start thumbnail generator, err: %v", err)
+		return
+	}
+	Default = g
+	metrics.RegisterSemaphore("thumb", g.sem)
+	log.Debugf("successfully started thumbnail generator, dir: %s", config.ThumbDirectory)
+}
+
+func NewGenerator(dir string, maxPixels int64, concurrency int) (*Generator, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Generator{
+		dir:       dir,
+		maxPixels: maxPixels,
+		sem:       semaphore.New(concurrency),
+		inflight:  map[string]*call{},
+		prepare:   make(chan string, prepareQueueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	go g.prepareLoop()
+	return g, nil
+}
+
+// Stop preparing thumbnails, a generation in progress is finished.
+func (g *Generator) Close() {
+	g.cancel()
+}
+
+func IsValidSize(size string) bool {
+	_, ok := sizes[size]
+	return ok
+}
+
+// Check the extension is a supported image format.
+func IsImage(filePath string) bool {
+	switch strings.ToLower(utils.GetFileExtension(path.Base(filePath))) {
+	case "jpg", "jpeg", "png", "gif", "webp":
+		return true
+	}
+	return false
+}
+
+/*
+Return the cached thumbnail of fullPath, generating it first if needed.
+Waits for a generation slot until ctx is done, a generation once started is finished for the other requests.
+*/
+func (g *Generator) Get(ctx context.Context, fullPath string, size string) (*Thumbnail, error) {
+	px, ok := sizes[size]
+	if !ok {
+		return nil, ErrSize
+	}
+	if !IsImage(fullPath) {
+		return nil, ErrNotImage
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotImage
+	}
+
+	thumb := g.thumbnail(fullPath, info, size)
+	_, err = os.Stat(thumb.FilePath)
+	if err == nil {
+		return thumb, nil
+	}
+
+	// share the work with requests of the same thumbnail
+	g.mu.Lock()
+	c, ok := g.inflight[thumb.FilePath]
+	for ok {
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !isCancelled(c.err) {
+			return c.thumb, c.err
+		}
+		// the request generating it gave up while waiting, take over
+		g.mu.Lock()
+		c, ok = g.inflight[thumb.FilePath]
+	}
+	c = &call{done: make(chan struct{})}
+	g.inflight[thumb.FilePath] = c
+	g.mu.Unlock()
+
+	c.err = g.sem.AcquireContext(ctx)
+	if c.err == nil {
+		c.err = g.generate(fullPath, thumb, px)
+		g.sem.Release()
+	}
+	if c.err == nil {
+		c.thumb = thumb
+	}
+
+	g.mu.Lock()
+	delete(g.inflight, thumb.FilePath)
+	g.mu.Unlock()
+	close(c.done)
+	return c.thumb, c.err
+}
+
+func isCancelled(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+/*
+Generate the thumbnails of fullPath in background, used after upload.
+Images are queued for a single worker, so that a large upload does not start a generation per image;
+when the queue is full the thumbnail is generated on its first request instead.
+*/
+func (g *Generator) Prepare(fullPath string) {
+	if !IsImage(fullPath) {
+		return
+	}
+	select {
+	case g.prepare <- fullPath:
+	default:
+		log.Warnf("thumbnail queue is full, skip preparing %s", fullPath)
+	}
+}
+
+func (g *Generator) prepareLoop() {
+	for {
+		select {
+		case fullPath := <-g.prepare:
+			_, err := g.Get(g.ctx, fullPath, SIZE_SMALL)
+			if err != nil && !isCancelled(err) {
+				log.Warnf("failed to prepare thumbnail of %s, err: %v", fullPath, err)
+			}
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// Remove cached thumbnails of fullPath, used when it is modified or deleted.
+func (g *Generator) Invalidate(fullPath string) {
+	matches, err := filepath.Glob(path.Join(g.dir, pathKey(fullPath)+"_*"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, match := range matches {
+		err = os.Remove(match)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove thumbnail %s, err: %v", match, err)
+		}
+	}
+}
+
+// Remove thumbnails not used for maxAge, including those of deleted folders.
+func (g *Generator) Prune(maxAge time.Duration) {
+	entries, err := os.ReadDir(g.dir)
+	if err != nil {
+		log.Errorf("failed to read thumbnail cache, err: %v", err)
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if os.Remove(path.Join(g.dir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	log.Infof("pruned thumbnail cache, removed: %d", removed)
+}
+
+// Mark a thumbnail as used so that Prune keeps it.
+func (g *Generator) Touch(thumb *Thumbnail) {
+	now := time.Now()
+	_ = os.Chtimes(thumb.FilePath, now, now)
+}
+
+func (g *Generator) thumbnail(fullPath string, info os.FileInfo, size string) *Thumbnail {
+	version := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%s", info.ModTime().UnixNano(), info.Size(), size)))
+	etag := hex.EncodeToString(version[:8])
+	ext, contentType := ".png", "image/png"
+	switch strings.ToLower(utils.GetFileExtension(info.Name())) {
+	case "jpg", "jpeg":
+		ext, contentType = ".jpg", "image/jpeg"
+	}
+	return &Thumbnail{
+		FilePath:    path.Join(g.dir, pathKey(fullPath)+"_"+etag+"_"+size+ext),
+		ContentType: contentType,
+		ETag:        `"` + etag + `"`,
+	}
+}
+
+func (g *Generator) generate(fullPath string, thumb *Thumbnail, px int) error {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// refuse decompression bombs before decoding pixels
+	cfg, err := decodeConfig(f, fullPath)
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > g.maxPixels {
+		return ErrTooLarge
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	src, err := decode(f, fullPath)
+	if err != nil {
+		return err
+	}
+
+	dst := image.NewRGBA(fitRect(src.Bounds(), px))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	// write then rename so that readers never see a partial thumbnail
+	tmp, err := os.CreateTemp(g.dir, "tmp_*")
+	if err != nil {
+		return err
+	}
+	if thumb.ContentType == "image/jpeg" {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(tmp, dst)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// old versions of the same size are replaced
+	g.removeVersions(fullPath, thumb)
+	return os.Rename(tmp.Name(), thumb.FilePath)
+}
+
+func (g *Generator) removeVersions(fullPath string, thumb *Thumbnail) {
+	matches, _ := filepath.Glob(path.Join(g.dir, pathKey(fullPath)+"_*"))
+	suffix := thumb.FilePath[strings.LastIndex(thumb.FilePath, "_"):]
+	for _, match := range matches {
+		if match != thumb.FilePath && strings.HasSuffix(match, suffix) {
+			os.Remove(match)
+		}
+	}
+}
+
+// bounds keeping the aspect ratio with the longest side at most px
+func fitRect(b image.Rectangle, px int) image.Rectangle {
+	w, h := b.Dx(), b.Dy()
+	if w <= px && h <= px {
+		return image.Rect(0, 0, max(w, 1), max(h, 1))
+	}
+	if w >= h {
+		return image.Rect(0, 0, px, max(h*px/w, 1))
+	}
+	return image.Rect(0, 0, max(w*px/h, 1), px)
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func decodeConfig(r io.Reader, fullPath string) (image.Config, error) {
+	switch strings.ToLower(utils.GetFileExtension(path.Base(fullPath))) {
+	case "jpg", "jpeg":
+		return jpeg.DecodeConfig(r)
+	case "png":
+		return png.DecodeConfig(r)
+	case "gif":
+		return gif.DecodeConfig(r)
+	case "webp":
+		return webp.DecodeConfig(r)
+	}
+	return image.Config{}, ErrNotImage
+}
+
+// gif is decoded to its first frame
+func decode(r io.Reader, fullPath string) (image.Image, error) {
+	switch strings.ToLower(utils.GetFileExtension(path.Base(fullPath))) {
+	case "jpg", "jpeg":
+		return jpeg.Decode(r)
+	case "png":
+		return png.Decode(r)
+	case "gif":
+		return gif.Decode(r)
+	case "webp":
+		return webp.Decode(r)
+	}
+	return nil, ErrNotImage
+}
+
+// cache names start with a hash of the original path
+func pathKey(fullPath string) string {
+	sum := sha256.Sum256([]byte(path.Join(fullPath)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Parse the size parameter, a name or a pixel count of one of the sizes.
+func ParseSize(value string) (string, error) {
+	if value == "" {
+		return SIZE_SMALL, nil
+	}
+	if IsValidSize(value) {
+		return value, nil
+	}
+	px, err := strconv.Atoi(value)
+	if err == nil {
+		for name, p := range sizes {
+			if p == px {
+				return name, nil
+			}
+		}
+	}
+	return "", ErrSize
+}
@@ -1,5 +1,7 @@
 package validate
 
+import "strings"
+
 func CheckPathForDelete(parentPath string, childPath string) bool {
 	if !IsPathInclusive(parentPath, childPath) {
 		return false
@@ -23,6 +25,56 @@ func IsPathInclusive(parentPath string, childPath string) bool {
 	return true
 }
 
+const (
+	MAX_NAME_LENGTH = 250
+	MAX_PATH_DEPTH  = 32
+)
+
+// prefix of files being uploaded, names starting with it are reserved to the server
+const UPLOAD_TEMP_PREFIX = ".upload-"
+
+// Name of a single file or folder, no separators, no parent reference, no control characters and not reserved
+func IsValidFileName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > MAX_NAME_LENGTH || IsReservedName(name) {
+		return false
+	}
+	for _, c := range name {
+		if c == '/' || c == '\\' || c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Relative path sent by a client such as "photos/2021/a.jpg", every component is checked on its own
+func IsValidRelativePath(p string) bool {
+	components := strings.Split(p, "/")
+	if len(components) > MAX_PATH_DEPTH {
+		return false
+	}
+	for _, name := range components {
+		if !IsValidFileName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether name is kept for files of the server itself, such as uploads in progress
+func IsReservedName(name string) bool {
+	return strings.HasPrefix(name, UPLOAD_TEMP_PREFIX)
+}
+
+// Whether any component of p is a reserved name, for paths a client asks to create
+func HasReservedName(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if IsReservedName(name) {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	READ_MODE    = 'r'
 	WRITE_MODE   = 'w'
@@ -0,0 +1,220 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/fsnotify/fsnotify"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/fs"
+)
+
+const (
+	EVENT_CREATE = "create"
+	EVENT_MODIFY = "modify"
+	EVENT_DELETE = "delete"
+	EVENT_RENAME = "rename"
+)
+
+// buffered events per subscriber, events are dropped for slow subscribers
+const subscriberBuffer = 64
+
+type Event struct {
+	Type     string
+	FullPath string
+	IsDir    bool
+}
+
+/*
+Watch a directory tree recursively and publish changes to subscribers of the parent directory.
+Bursty events of the same path are merged, an event is only published after the path has been
+quiet for the debounce period.
+*/
+type Watcher struct {
+	root     string
+	debounce time.Duration
+	fsw      *fsnotify.Watcher
+
+	mu      sync.Mutex
+	subs    map[string]map[chan *Event]struct{}
+	pending map[string]*pendingEvent
+	done    chan struct{}
+}
+
+type pendingEvent struct {
+	event *Event
+	timer *time.Timer
+}
+
+var Default *Watcher
+
+func Init() {
+	if !config.WatchEnabled {
+		log.Info("directory watching is disabled")
+		return
+	}
+	w, err := NewWatcher(config.PublicDirectoryRoot, time.Duration(config.WatchDebounceMs)*time.Millisecond)
+	if err != nil {
+		log.Errorf("failed to start directory watcher, err: %v", err)
+		return
+	}
+	Default = w
+	log.Debugf("successfully started directory watcher on %s", config.PublicDirectoryRoot)
+}
+
+func NewWatcher(root string, debounce time.Duration) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		root:     root,
+		debounce: debounce,
+		fsw:      fsw,
+		subs:     map[string]map[chan *Event]struct{}{},
+		pending:  map[string]*pendingEvent{},
+		done:     make(chan struct{}),
+	}
+	err = w.addRecursive(root)
+	if err != nil {
+		fsw.Close()
+		return nil, err
+	}
+	go w.loop()
+	return w, nil
+}
+
+func (w *Watcher) Stop() {
+	close(w.done)
+	w.fsw.Close()
+}
+
+/*
+Subscribe changes of direct children of a directory
+
+return:
+- channel of events
+- function to unsubscribe, the channel is closed after it is called
+*/
+func (w *Watcher) Subscribe(dirPath string) (<-chan *Event, func()) {
+	dirPath = filepath.Clean(dirPath)
+	ch := make(chan *Event, subscriberBuffer)
+	w.mu.Lock()
+	if w.subs[dirPath] == nil {
+		w.subs[dirPath] = map[chan *Event]struct{}{}
+	}
+	w.subs[dirPath][ch] = struct{}{}
+	w.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs[dirPath], ch)
+			if len(w.subs[dirPath]) == 0 {
+				delete(w.subs, dirPath)
+			}
+			w.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (w *Watcher) loop() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case e, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(e)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("directory watcher error: %v", err)
+		}
+	}
+}
+
+func (w *Watcher) handle(e fsnotify.Event) {
+	// files being uploaded are announced once they get their name, deletes staged by batches are not announced
+	if fs.IsInternal(e.Name) || fs.IsInternal(filepath.Dir(e.Name)) {
+		return
+	}
+	event := &Event{FullPath: filepath.Clean(e.Name)}
+	switch {
+	case e.Op&fsnotify.Create != 0:
+		event.Type = EVENT_CREATE
+		info, err := os.Stat(e.Name)
+		if err == nil && info.IsDir() {
+			event.IsDir = true
+			// new folders are not watched by inotify automatically
+			err = w.addRecursive(e.Name)
+			if err != nil {
+				log.Errorf("failed to watch %s, err: %v", e.Name, err)
+			}
+		}
+	case e.Op&fsnotify.Remove != 0:
+		event.Type = EVENT_DELETE
+	case e.Op&fsnotify.Rename != 0:
+		event.Type = EVENT_RENAME
+	case e.Op&fsnotify.Write != 0:
+		event.Type = EVENT_MODIFY
+	default:
+		return
+	}
+	w.schedule(event)
+}
+
+// delay publishing until the path is quiet, a create followed by writes stays a create
+func (w *Watcher) schedule(event *Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.pending[event.FullPath]; ok {
+		if !(p.event.Type == EVENT_CREATE && event.Type == EVENT_MODIFY) {
+			p.event = event
+		}
+		p.timer.Reset(w.debounce)
+		return
+	}
+	p := &pendingEvent{event: event}
+	p.timer = time.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		delete(w.pending, event.FullPath)
+		e := p.event
+		w.publishLocked(e)
+		w.mu.Unlock()
+	})
+	w.pending[event.FullPath] = p
+}
+
+func (w *Watcher) publishLocked(e *Event) {
+	for ch := range w.subs[filepath.Dir(e.FullPath)] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (w *Watcher) addRecursive(dirPath string) error {
+	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// folder may be removed while walking
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if fs.IsInternal(path) {
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(path)
+	})
+}
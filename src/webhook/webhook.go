@@ -0,0 +1,394 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/lyokalita/naspublic.ftserver/src/config"
+	"github.com/lyokalita/naspublic.ftserver/src/utils"
+)
+
+const (
+	EVENT_UPLOAD_COMPLETED = "upload.completed"
+	EVENT_DIR_CREATED      = "dir.created"
+	EVENT_DELETED          = "deleted"
+	EVENT_DOWNLOAD_SIGNED  = "download.signed"
+	EVENT_DROPBOX_RECEIVED = "dropbox.received"
+	EVENT_MOVED            = "moved"
+	EVENT_COPIED           = "copied"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Naspublic-Signature"
+	EVENT_HEADER     = "X-Naspublic-Event"
+	DELIVERY_HEADER  = "X-Naspublic-Delivery"
+)
+
+const (
+	initialBackoff = time.Second
+	maxBackoff     = 10 * time.Minute
+	requestTimeout = 10 * time.Second
+	queueSize      = 1024
+)
+
+type Event struct {
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	TokenId string `json:"tokenId,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+}
+
+// One event to be sent to one url, persisted in the outbox until it is delivered
+type delivery struct {
+	Id       string          `json:"id"`
+	Url      string          `json:"url"`
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+}
+
+type Dispatcher struct {
+	urls           []string
+	secret         []byte
+	outbox         string
+	maxAttempts    int
+	retryInterval  time.Duration
+	initialBackoff time.Duration
+	client         *http.Client
+	queues         map[string]chan *delivery // one queue and worker per url so a slow receiver only delays its own events
+	mu             sync.Mutex
+	pending        map[string]bool // deliveries queued or waiting for a retry, the rest of the outbox is replayed
+	done           chan struct{}
+	wg             sync.WaitGroup
+}
+
+var Default *Dispatcher
+
+func Init() {
+	if len(config.WebhookUrls) == 0 {
+		log.Info("no webhook configured")
+		return
+	}
+	d, err := NewDispatcher(config.WebhookUrls, config.WebhookSecret, config.WebhookOutbox, config.WebhookMaxAttempts, time.Duration(config.WebhookRetrySec)*time.Second)
+	if err != nil {
+		log.Errorf("failed to start webhook dispatcher, err: %v", err)
+		return
+	}
+	Default = d
+	log.Debugf("successfully started webhook dispatcher, urls: %v, outbox: %s", config.WebhookUrls, config.WebhookOutbox)
+}
+
+/*
+Start one worker per url, deliveries left in the outbox are sent first.
+
+param:
+- retryInterval: how often the outbox is scanned for deliveries that could not be queued, 0 to scan only at start
+*/
+func NewDispatcher(urls []string, secret []byte, outbox string, maxAttempts int, retryInterval time.Duration) (*Dispatcher, error) {
+	d, err := newDispatcher(urls, secret, outbox, maxAttempts, retryInterval)
+	if err != nil {
+		return nil, err
+	}
+	d.start()
+	return d, nil
+}
+
+func newDispatcher(urls []string, secret []byte, outbox string, maxAttempts int, retryInterval time.Duration) (*Dispatcher, error) {
+	err := os.MkdirAll(path.Join(outbox, "failed"), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		urls:           urls,
+		secret:         secret,
+		outbox:         outbox,
+		maxAttempts:    maxAttempts,
+		retryInterval:  retryInterval,
+		initialBackoff: initialBackoff,
+		client:         &http.Client{Timeout: requestTimeout},
+		queues:         map[string]chan *delivery{},
+		pending:        map[string]bool{},
+		done:           make(chan struct{}),
+	}
+	for _, url := range urls {
+		d.queues[url] = make(chan *delivery, queueSize)
+	}
+	return d, nil
+}
+
+func (d *Dispatcher) start() {
+	for _, queue := range d.queues {
+		d.wg.Add(1)
+		go d.work(queue)
+	}
+	d.replay()
+	if d.retryInterval > 0 {
+		d.wg.Add(1)
+		go d.replayEvery(d.retryInterval)
+	}
+}
+
+// Publish an event to the default dispatcher, no-op if webhooks are not configured.
+func Emit(e *Event) {
+	if Default == nil {
+		return
+	}
+	Default.Emit(e)
+}
+
+func (d *Dispatcher) Emit(e *Event) {
+	if e.Id == "" {
+		e.Id = string(utils.GetRandomBytes(16))
+	}
+	if e.Time == "" {
+		e.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("failed to encode webhook event %v, err: %v", *e, err)
+		return
+	}
+	for i, url := range d.urls {
+		dl := &delivery{
+			Id:      fmt.Sprintf("%s-%d", e.Id, i),
+			Url:     url,
+			Type:    e.Type,
+			Payload: payload,
+		}
+		// persist first so that the event survives a restart
+		err = d.save(dl)
+		if err != nil {
+			log.Errorf("failed to persist webhook delivery %s, err: %v", dl.Id, err)
+		}
+		d.enqueue(dl)
+	}
+}
+
+func (d *Dispatcher) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// queue a delivery unless it is already pending, return false if it is left to the next replay
+func (d *Dispatcher) enqueue(dl *delivery) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[dl.Id] {
+		return false
+	}
+	return d.sendLocked(dl)
+}
+
+func (d *Dispatcher) sendLocked(dl *delivery) bool {
+	queue, ok := d.queues[dl.Url]
+	if !ok {
+		log.Errorf("webhook url %s of delivery %s is no longer configured", dl.Url, dl.Id)
+		d.fail(dl)
+		return false
+	}
+	select {
+	case queue <- dl:
+		d.pending[dl.Id] = true
+		return true
+	default:
+		// delivery stays in the outbox and is sent by the next replay
+		delete(d.pending, dl.Id)
+		log.Errorf("webhook queue of %s is full, delivery %s postponed", dl.Url, dl.Id)
+		return false
+	}
+}
+
+// queue a pending delivery again after its backoff
+func (d *Dispatcher) requeue(dl *delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sendLocked(dl)
+}
+
+// forget a delivery once it is removed from the outbox
+func (d *Dispatcher) finish(dl *delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, dl.Id)
+}
+
+func (d *Dispatcher) work(queue chan *delivery) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case dl := <-queue:
+			d.deliver(dl)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(dl *delivery) {
+	dl.Attempts++
+	err := d.post(dl)
+	if err == nil {
+		d.remove(dl)
+		d.finish(dl)
+		log.Debugf("webhook %s delivered to %s", dl.Id, dl.Url)
+		return
+	}
+
+	if dl.Attempts >= d.maxAttempts {
+		log.Errorf("webhook %s to %s dropped after %d attempts, err: %v", dl.Id, dl.Url, dl.Attempts, err)
+		if err := d.save(dl); err != nil {
+			log.Errorf("failed to persist webhook delivery %s, err: %v", dl.Id, err)
+		}
+		d.fail(dl)
+		d.finish(dl)
+		return
+	}
+
+	backoff := d.initialBackoff << (dl.Attempts - 1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	log.Infof("webhook %s to %s failed, retry in %v, err: %v", dl.Id, dl.Url, backoff, err)
+	if err := d.save(dl); err != nil {
+		log.Errorf("failed to persist webhook delivery %s, err: %v", dl.Id, err)
+	}
+	time.AfterFunc(backoff, func() {
+		select {
+		case <-d.done:
+		default:
+			d.requeue(dl)
+		}
+	})
+}
+
+func (d *Dispatcher) post(dl *delivery) error {
+	req, err := http.NewRequest(http.MethodPost, dl.Url, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EVENT_HEADER, dl.Type)
+	req.Header.Set(DELIVERY_HEADER, dl.Id)
+	req.Header.Set(SIGNATURE_HEADER, "sha256="+Sign(d.secret, dl.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Hex encoded HMAC-SHA256 of payload, receivers compare it with the signature header.
+func Sign(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) filePath(dl *delivery) string {
+	return path.Join(d.outbox, dl.Id+".json")
+}
+
+func (d *Dispatcher) save(dl *delivery) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	// write then rename so that a crash never leaves a partial file
+	tmp := d.filePath(dl) + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.filePath(dl))
+}
+
+func (d *Dispatcher) remove(dl *delivery) {
+	err := os.Remove(d.filePath(dl))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove webhook delivery %s, err: %v", dl.Id, err)
+	}
+}
+
+func (d *Dispatcher) fail(dl *delivery) {
+	err := os.Rename(d.filePath(dl), path.Join(d.outbox, "failed", dl.Id+".json"))
+	if err != nil {
+		log.Errorf("failed to move webhook delivery %s, err: %v", dl.Id, err)
+	}
+}
+
+func (d *Dispatcher) replayEvery(interval time.Duration) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.replay()
+		}
+	}
+}
+
+// enqueue deliveries of the outbox that are not pending, left by a previous run or by a full queue
+func (d *Dispatcher) replay() {
+	files, err := filepath.Glob(path.Join(d.outbox, "*.json"))
+	if err != nil {
+		log.Errorf("failed to read webhook outbox, err: %v", err)
+		return
+	}
+	replayed := 0
+	for _, file := range files {
+		d.mu.Lock()
+		pending := d.pending[strings.TrimSuffix(path.Base(file), ".json")]
+		d.mu.Unlock()
+		if pending {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			// delivered meanwhile
+			continue
+		}
+		if err != nil {
+			log.Errorf("failed to read webhook delivery %s, err: %v", file, err)
+			continue
+		}
+		dl := &delivery{}
+		err = json.Unmarshal(b, dl)
+		if err != nil {
+			log.Errorf("invalid webhook delivery %s, err: %v", file, err)
+			continue
+		}
+		if d.enqueue(dl) {
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		log.Infof("replayed %d webhook deliveries from outbox", replayed)
+	}
+}
@@ -0,0 +1,248 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test secret")
+
+// receiver recording deliveries, status decides the response to each attempt
+type receiver struct {
+	mu       sync.Mutex
+	bodies   [][]byte
+	headers  []http.Header
+	status   func(attempt int) int
+	received chan struct{}
+}
+
+func newReceiver(status func(attempt int) int) (*receiver, *httptest.Server) {
+	rc := &receiver{status: status, received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rc.mu.Lock()
+		rc.bodies = append(rc.bodies, body)
+		rc.headers = append(rc.headers, r.Header.Clone())
+		attempt := len(rc.bodies)
+		rc.mu.Unlock()
+		rw.WriteHeader(rc.status(attempt))
+		rc.received <- struct{}{}
+	}))
+	return rc, srv
+}
+
+func (rc *receiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rc.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d requests", i, n)
+		}
+	}
+}
+
+func ok(int) int { return http.StatusOK }
+
+func startDispatcher(t *testing.T, urls []string, maxAttempts int, retryInterval time.Duration) *Dispatcher {
+	t.Helper()
+	d, err := newDispatcher(urls, testSecret, t.TempDir(), maxAttempts, retryInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.initialBackoff = 10 * time.Millisecond
+	d.start()
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// wait until the outbox holds n deliveries, failed ones excluded
+func waitOutbox(t *testing.T, d *Dispatcher, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := ioutil.ReadDir(d.outbox)
+		count := 0
+		for _, f := range files {
+			if !f.IsDir() {
+				count++
+			}
+		}
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d deliveries in outbox, got %d", n, count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	rc, srv := newReceiver(ok)
+	defer srv.Close()
+	d := startDispatcher(t, []string{srv.URL}, 3, 0)
+
+	d.Emit(&Event{Type: EVENT_DELETED, Path: "/a/b.txt"})
+	rc.wait(t, 1)
+
+	body, header := rc.bodies[0], rc.headers[0]
+	if header.Get(SIGNATURE_HEADER) != "sha256="+Sign(testSecret, body) {
+		t.Fatalf("signature %s does not match body", header.Get(SIGNATURE_HEADER))
+	}
+	if header.Get(EVENT_HEADER) != EVENT_DELETED {
+		t.Fatalf("unexpected event header %s", header.Get(EVENT_HEADER))
+	}
+	e := &Event{}
+	if err := json.Unmarshal(body, e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EVENT_DELETED || e.Path != "/a/b.txt" || e.Id == "" || e.Time == "" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if header.Get(DELIVERY_HEADER) != e.Id+"-0" {
+		t.Fatalf("unexpected delivery id %s", header.Get(DELIVERY_HEADER))
+	}
+	waitOutbox(t, d, 0)
+}
+
+func TestSignKnownValue(t *testing.T) {
+	// printf '{}' | openssl dgst -sha256 -hmac 'test secret'
+	expected := "9b26db71a63ff5bc544bf44ce95b61573cc87283325f7c0a18c5e8c8c8bcb6b7"
+	if got := Sign(testSecret, []byte("{}")); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	rc, srv := newReceiver(func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	defer srv.Close()
+	d := startDispatcher(t, []string{srv.URL}, 5, 0)
+
+	start := time.Now()
+	d.Emit(&Event{Type: EVENT_DIR_CREATED})
+	rc.wait(t, 3)
+
+	// 10ms then 20ms between attempts
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("retries did not back off, took %v", elapsed)
+	}
+	for _, body := range rc.bodies[1:] {
+		if string(body) != string(rc.bodies[0]) {
+			t.Fatal("retry sent a different payload")
+		}
+	}
+	waitOutbox(t, d, 0)
+}
+
+func TestDropAfterMaxAttempts(t *testing.T) {
+	rc, srv := newReceiver(func(int) int { return http.StatusBadGateway })
+	defer srv.Close()
+	d := startDispatcher(t, []string{srv.URL}, 2, 0)
+
+	d.Emit(&Event{Id: "dropped", Type: EVENT_DELETED})
+	rc.wait(t, 2)
+	waitOutbox(t, d, 0)
+
+	b, err := ioutil.ReadFile(path.Join(d.outbox, "failed", "dropped-0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := &delivery{}
+	json.Unmarshal(b, dl)
+	if dl.Attempts != 2 {
+		t.Fatalf("expected 2 attempts recorded, got %d", dl.Attempts)
+	}
+	select {
+	case <-rc.received:
+		t.Fatal("delivery retried after the last attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func writeDelivery(t *testing.T, outbox string, dl *delivery) {
+	t.Helper()
+	b, _ := json.Marshal(dl)
+	if err := ioutil.WriteFile(path.Join(outbox, dl.Id+".json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayOutboxAtStart(t *testing.T) {
+	rc, srv := newReceiver(ok)
+	defer srv.Close()
+
+	outbox := t.TempDir()
+	writeDelivery(t, outbox, &delivery{Id: "left-0", Url: srv.URL, Type: EVENT_DELETED, Payload: json.RawMessage(`{"id":"left"}`), Attempts: 1})
+
+	d, err := NewDispatcher([]string{srv.URL}, testSecret, outbox, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	rc.wait(t, 1)
+	if string(rc.bodies[0]) != `{"id":"left"}` {
+		t.Fatalf("unexpected payload %s", rc.bodies[0])
+	}
+	waitOutbox(t, d, 0)
+}
+
+func TestReplayOutboxPeriodically(t *testing.T) {
+	rc, srv := newReceiver(ok)
+	defer srv.Close()
+	d := startDispatcher(t, []string{srv.URL}, 3, 20*time.Millisecond)
+
+	// as left by a full queue: persisted but never queued
+	writeDelivery(t, d.outbox, &delivery{Id: "postponed-0", Url: srv.URL, Type: EVENT_DELETED, Payload: json.RawMessage(`{}`)})
+	rc.wait(t, 1)
+	waitOutbox(t, d, 0)
+
+	select {
+	case <-rc.received:
+		t.Fatal("delivery replayed twice")
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+func TestReplayDropsUnknownUrl(t *testing.T) {
+	outbox := t.TempDir()
+	writeDelivery(t, outbox, &delivery{Id: "gone-0", Url: "http://127.0.0.1:1/removed", Payload: json.RawMessage(`{}`)})
+	d, err := NewDispatcher([]string{"http://127.0.0.1:1/other"}, testSecret, outbox, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	if _, err := os.Stat(path.Join(outbox, "failed", "gone-0.json")); err != nil {
+		t.Fatalf("delivery to a removed url not moved to failed, err: %v", err)
+	}
+}
+
+func TestSlowReceiverDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	rc, fast := newReceiver(ok)
+	defer fast.Close()
+
+	d := startDispatcher(t, []string{slow.URL, fast.URL}, 3, 0)
+	for i := 0; i < 3; i++ {
+		d.Emit(&Event{Type: EVENT_DELETED})
+	}
+	rc.wait(t, 3)
+}